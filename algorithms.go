@@ -0,0 +1,293 @@
+package sshmgr
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// AlgorithmProfile is a named set of ssh algorithms offered in negotiation
+type AlgorithmProfile string
+
+const (
+	// ProfileModern offers only current AEAD and CTR ciphers, ECDH key exchanges,
+	// SHA-2 MACs and ECDSA/Ed25519 host keys. RSA host keys are not offered as the
+	// rsa-sha2-256 and rsa-sha2-512 signatures are not supported, so servers with
+	// only a RSA host key require the compatible profile
+	ProfileModern AlgorithmProfile = "modern"
+
+	// ProfileCompatible offers the library defaults with CTR ciphers preferred
+	// over AEAD ones to prevent early negotiation failures with older servers.
+	// This is the default profile
+	ProfileCompatible AlgorithmProfile = "compatible"
+
+	// ProfileLegacy additionally offers CBC and RC4 ciphers, SHA-1 key exchanges,
+	// MACs and DSA host keys for old network gear and embedded servers
+	ProfileLegacy AlgorithmProfile = "legacy"
+)
+
+// algorithmSet holds the algorithms offered for each negotiation category.
+// A nil list uses the library defaults
+type algorithmSet struct {
+	ciphers  []string
+	kex      []string
+	macs     []string
+	hostKeys []string
+}
+
+var profiles = map[AlgorithmProfile]algorithmSet{
+	ProfileModern: {
+		ciphers: []string{
+			"chacha20-poly1305@openssh.com", "aes128-gcm@openssh.com",
+			"aes256-ctr", "aes192-ctr", "aes128-ctr",
+		},
+		kex: []string{
+			"curve25519-sha256@libssh.org",
+			"ecdh-sha2-nistp256", "ecdh-sha2-nistp384", "ecdh-sha2-nistp521",
+		},
+		macs: []string{"hmac-sha2-256-etm@openssh.com", "hmac-sha2-256"},
+		hostKeys: []string{
+			ssh.CertAlgoED25519v01, ssh.CertAlgoECDSA256v01, ssh.CertAlgoECDSA384v01, ssh.CertAlgoECDSA521v01,
+			ssh.KeyAlgoED25519, ssh.KeyAlgoECDSA256, ssh.KeyAlgoECDSA384, ssh.KeyAlgoECDSA521,
+		},
+	},
+	ProfileCompatible: {
+		ciphers: []string{
+			"aes256-ctr", "aes192-ctr", "aes128-ctr",
+			"chacha20-poly1305@openssh.com", "aes128-gcm@openssh.com",
+		},
+	},
+	ProfileLegacy: {
+		ciphers: []string{
+			"aes256-ctr", "aes192-ctr", "aes128-ctr", "aes128-gcm@openssh.com",
+			"chacha20-poly1305@openssh.com", "aes128-cbc", "3des-cbc",
+			"arcfour256", "arcfour128", "arcfour",
+		},
+		kex: []string{
+			"curve25519-sha256@libssh.org",
+			"ecdh-sha2-nistp256", "ecdh-sha2-nistp384", "ecdh-sha2-nistp521",
+			"diffie-hellman-group14-sha1", "diffie-hellman-group1-sha1",
+		},
+		macs: []string{"hmac-sha2-256-etm@openssh.com", "hmac-sha2-256", "hmac-sha1", "hmac-sha1-96"},
+		hostKeys: []string{
+			ssh.CertAlgoRSAv01, ssh.CertAlgoDSAv01, ssh.CertAlgoECDSA256v01,
+			ssh.CertAlgoECDSA384v01, ssh.CertAlgoECDSA521v01, ssh.CertAlgoED25519v01,
+			ssh.KeyAlgoECDSA256, ssh.KeyAlgoECDSA384, ssh.KeyAlgoECDSA521,
+			ssh.KeyAlgoRSA, ssh.KeyAlgoDSA, ssh.KeyAlgoED25519,
+		},
+	},
+}
+
+// applyAlgorithms sets the algorithms of the config profile and overrides on c
+func applyAlgorithms(c *ssh.ClientConfig, config ClientConfig) (err error) {
+	profile := config.Algorithms
+	if profile == "" {
+		profile = ProfileCompatible
+	}
+
+	set, ok := profiles[profile]
+	if !ok {
+		return fmt.Errorf("invalid client config: unknown algorithm profile %q", profile)
+	}
+
+	c.Ciphers = pick(config.Ciphers, set.ciphers)
+	c.KeyExchanges = pick(config.KeyExchanges, set.kex)
+	c.MACs = pick(config.MACs, set.macs)
+	c.HostKeyAlgorithms = pick(config.HostKeyAlgorithms, set.hostKeys)
+	return nil
+}
+
+// pick returns override if not empty or def
+func pick(override, def []string) (algos []string) {
+	if len(override) > 0 {
+		return override
+	}
+	return def
+}
+
+// Algorithms reports the algorithms negotiated on the initial key exchange
+type Algorithms struct {
+	KeyExchange        string
+	HostKey            string
+	CipherClientServer string
+	CipherServerClient string
+	MACClientServer    string
+	MACServerClient    string
+}
+
+// Algorithms returns the algorithms negotiated with the server
+func (c *Client) Algorithms() (algos Algorithms) {
+	c.mtx.RLock()
+	defer c.mtx.RUnlock()
+	return c.algos
+}
+
+// kexInit name-list indexes in the SSH_MSG_KEXINIT payload
+const (
+	kexInitKex = iota
+	kexInitHostKey
+	kexInitCipherClientServer
+	kexInitCipherServerClient
+	kexInitMACClientServer
+	kexInitMACServerClient
+	kexInitNameLists = 10
+)
+
+const (
+	msgKexInit = 20
+	// maxKexInitCapture bounds the bytes buffered while looking for the KEXINIT
+	maxKexInitCapture = 64 << 10
+)
+
+// negotiate computes the negotiated algorithms from the client and server
+// KEXINIT name-lists, picking the first client algorithm the server supports
+func negotiate(client, server [][]string) (algos Algorithms) {
+	common := func(i int) string {
+		for _, a := range client[i] {
+			for _, b := range server[i] {
+				if a == b {
+					return a
+				}
+			}
+		}
+		return ""
+	}
+
+	return Algorithms{
+		KeyExchange:        common(kexInitKex),
+		HostKey:            common(kexInitHostKey),
+		CipherClientServer: common(kexInitCipherClientServer),
+		CipherServerClient: common(kexInitCipherServerClient),
+		MACClientServer:    common(kexInitMACClientServer),
+		MACServerClient:    common(kexInitMACServerClient),
+	}
+}
+
+// kexInitCapture records a stream until its first SSH_MSG_KEXINIT is parsed.
+// The first key exchange is unencrypted, so the offered algorithms can be
+// read directly from the wire. Once done, writes return without locking
+type kexInitCapture struct {
+	mtx   sync.Mutex
+	buf   []byte
+	done  atomic.Bool
+	names [][]string
+}
+
+func (k *kexInitCapture) write(p []byte) {
+	if k.done.Load() {
+		return
+	}
+
+	k.mtx.Lock()
+	defer k.mtx.Unlock()
+
+	if k.done.Load() {
+		return
+	}
+
+	k.buf = append(k.buf, p...)
+	if len(k.buf) > maxKexInitCapture {
+		k.buf = nil
+		k.done.Store(true)
+		return
+	}
+
+	if names, ok := parseKexInit(k.buf); ok {
+		k.buf, k.names = nil, names
+		k.done.Store(true)
+	}
+}
+
+func (k *kexInitCapture) nameLists() (names [][]string) {
+	k.mtx.Lock()
+	defer k.mtx.Unlock()
+	return k.names
+}
+
+// parseKexInit parses the name-lists of the KEXINIT following the identification
+// lines in b. Returns false if more data is needed. A first packet that is not
+// a valid KEXINIT yields nil name-lists
+func parseKexInit(b []byte) (names [][]string, ok bool) {
+	for {
+		i := bytes.IndexByte(b, '\n')
+		if i < 0 {
+			return nil, false
+		}
+		line := b[:i]
+		b = b[i+1:]
+		if bytes.HasPrefix(line, []byte("SSH-")) {
+			break
+		}
+	}
+
+	if len(b) < 5 {
+		return nil, false
+	}
+
+	length := binary.BigEndian.Uint32(b)
+	if uint64(len(b)-4) < uint64(length) {
+		return nil, false
+	}
+
+	padding := uint32(b[4])
+	if length < padding+1 {
+		return nil, true
+	}
+
+	// Skip the message type and the 16 byte cookie
+	payload := b[5 : 4+length-padding]
+	if len(payload) < 17 || payload[0] != msgKexInit {
+		return nil, true
+	}
+	payload = payload[17:]
+
+	names = make([][]string, 0, kexInitNameLists)
+	for i := 0; i < kexInitNameLists; i++ {
+		if len(payload) < 4 {
+			return nil, true
+		}
+		size := binary.BigEndian.Uint32(payload)
+		if uint64(len(payload)-4) < uint64(size) {
+			return nil, true
+		}
+		names = append(names, strings.Split(string(payload[4:4+size]), ","))
+		payload = payload[4+size:]
+	}
+
+	return names, true
+}
+
+// kexInitConn captures the client and server KEXINIT messages of a connection.
+// It is only used during the handshake, the ssh transport keeps reading and writing
+// through it afterwards without locking once both messages were captured
+type kexInitConn struct {
+	net.Conn
+	client kexInitCapture
+	server kexInitCapture
+}
+
+func (c *kexInitConn) Read(p []byte) (n int, err error) {
+	n, err = c.Conn.Read(p)
+	c.server.write(p[:n])
+	return n, err
+}
+
+func (c *kexInitConn) Write(p []byte) (n int, err error) {
+	c.client.write(p)
+	return c.Conn.Write(p)
+}
+
+// algorithms returns the negotiated algorithms once both KEXINIT were captured
+func (c *kexInitConn) algorithms() (algos Algorithms) {
+	client, server := c.client.nameLists(), c.server.nameLists()
+	if client == nil || server == nil {
+		return algos
+	}
+	return negotiate(client, server)
+}
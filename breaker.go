@@ -0,0 +1,196 @@
+package sshmgr
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// ErrCircuitOpen is matched by errors returned while dialing a host is suspended
+var ErrCircuitOpen = errors.New("circuit breaker open")
+
+// CircuitOpenError is returned when dialing a host is suspended
+// after consecutive dial or handshake failures
+type CircuitOpenError struct {
+	// Host is the host:port of the suspended host
+	Host string
+	// Until is the time after which a single probe dial will be allowed
+	Until time.Time
+}
+
+func (e *CircuitOpenError) Error() (s string) {
+	return fmt.Sprintf("circuit breaker open for %s until %s", e.Host, e.Until.Format(time.RFC3339))
+}
+
+// Unwrap allows matching the error with errors.Is(err, ErrCircuitOpen)
+func (e *CircuitOpenError) Unwrap() (err error) {
+	return ErrCircuitOpen
+}
+
+// BreakerState is the state of a host circuit breaker
+type BreakerState int
+
+const (
+	// BreakerClosed allows dialing the host
+	BreakerClosed BreakerState = iota
+	// BreakerOpen fails dials fast until the cooldown expires
+	BreakerOpen
+	// BreakerHalfOpen allows a single probe dial after the cooldown
+	BreakerHalfOpen
+)
+
+func (s BreakerState) String() (str string) {
+	switch s {
+	case BreakerClosed:
+		return "closed"
+	case BreakerOpen:
+		return "open"
+	case BreakerHalfOpen:
+		return "half-open"
+	}
+	return "unknown"
+}
+
+// BreakerStats reports the state of a host circuit breaker
+type BreakerStats struct {
+	State BreakerState
+	// Failures is the number of consecutive dial or handshake failures
+	Failures int
+	// OpenUntil is the end of the current cooldown when the breaker is open
+	OpenUntil time.Time
+}
+
+// breaker is the circuit breaker state for a single host
+type breaker struct {
+	state    BreakerState
+	failures int
+	trips    int
+	until    time.Time
+}
+
+// breakers tracks circuit breakers per host.
+// A threshold <= 0 disables circuit breaking
+type breakers struct {
+	mtx         sync.Mutex
+	threshold   int
+	cooldown    time.Duration
+	maxCooldown time.Duration
+	hosts       map[string]*breaker
+}
+
+func newBreakers() (b *breakers) {
+	return &breakers{hosts: map[string]*breaker{}}
+}
+
+// check fails fast if the breaker for host is open without changing its state
+func (b *breakers) check(host string, now time.Time) (err error) {
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+
+	hb := b.hosts[host]
+	if hb == nil || hb.state == BreakerClosed {
+		return nil
+	}
+
+	if hb.state == BreakerOpen && now.Before(hb.until) {
+		return &CircuitOpenError{Host: host, Until: hb.until}
+	}
+	return nil
+}
+
+// allow reports whether host can be dialed. Once the cooldown of an open breaker
+// expires, the first caller is allowed as a probe and others fail until it completes
+func (b *breakers) allow(host string, now time.Time) (err error) {
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+
+	hb := b.hosts[host]
+	if b.threshold <= 0 || hb == nil {
+		return nil
+	}
+
+	switch hb.state {
+	case BreakerOpen:
+		if now.Before(hb.until) {
+			return &CircuitOpenError{Host: host, Until: hb.until}
+		}
+		hb.state = BreakerHalfOpen
+		return nil
+
+	case BreakerHalfOpen:
+		return &CircuitOpenError{Host: host, Until: hb.until}
+	}
+
+	return nil
+}
+
+// success closes the breaker for host
+func (b *breakers) success(host string) {
+	b.mtx.Lock()
+	delete(b.hosts, host)
+	b.mtx.Unlock()
+}
+
+// failure records a dial or handshake failure for host, opening the breaker
+// when the threshold is reached or a half-open probe fails.
+// The cooldown doubles on every consecutive trip up to maxCooldown
+func (b *breakers) failure(host string, now time.Time) {
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+
+	if b.threshold <= 0 {
+		return
+	}
+
+	hb := b.hosts[host]
+	if hb == nil {
+		hb = &breaker{}
+		b.hosts[host] = hb
+	}
+
+	hb.failures++
+	if hb.state == BreakerHalfOpen || hb.failures >= b.threshold {
+		hb.trips++
+		hb.state = BreakerOpen
+		hb.until = now.Add(b.backoff(hb.trips))
+	}
+}
+
+// abort releases a half-open probe that ended without reaching the host
+func (b *breakers) abort(host string) {
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+
+	if hb := b.hosts[host]; hb != nil && hb.state == BreakerHalfOpen {
+		hb.state = BreakerOpen
+	}
+}
+
+// backoff returns the cooldown for the given number of consecutive trips
+func (b *breakers) backoff(trips int) (cooldown time.Duration) {
+	cooldown = b.cooldown
+	for i := 1; i < trips; i++ {
+		cooldown *= 2
+		if b.maxCooldown > 0 && cooldown >= b.maxCooldown {
+			return b.maxCooldown
+		}
+	}
+
+	if b.maxCooldown > 0 && cooldown > b.maxCooldown {
+		return b.maxCooldown
+	}
+	return cooldown
+}
+
+// stats returns the state of all hosts with recorded failures
+func (b *breakers) stats() (stats map[string]BreakerStats) {
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+
+	stats = make(map[string]BreakerStats, len(b.hosts))
+	for host, hb := range b.hosts {
+		stats[host] = BreakerStats{State: hb.state, Failures: hb.failures, OpenUntil: hb.until}
+	}
+	return stats
+}
@@ -0,0 +1,57 @@
+package sshmgr
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestBreakerTransitions(t *testing.T) {
+	b := newBreakers()
+	b.threshold = 2
+	b.cooldown = time.Second
+	b.maxCooldown = 3 * time.Second
+
+	host := "hosta:22"
+	now := time.Now()
+
+	b.failure(host, now)
+	if err := b.allow(host, now); err != nil {
+		t.Fatalf("breaker should be closed below threshold, got: %s", err)
+	}
+
+	b.failure(host, now)
+	err := b.allow(host, now)
+	if !errors.Is(err, ErrCircuitOpen) {
+		t.Fatalf("expected ErrCircuitOpen, got: %v", err)
+	}
+
+	if err = b.check(host, now); err == nil {
+		t.Fatal("check should fail while the breaker is open")
+	}
+
+	// a single probe is allowed after the cooldown
+	now = now.Add(time.Second)
+	if err = b.allow(host, now); err != nil {
+		t.Fatalf("expected probe to be allowed, got: %s", err)
+	}
+
+	if err = b.allow(host, now); err == nil {
+		t.Fatal("only one probe should be allowed while half-open")
+	}
+
+	// failed probe doubles the cooldown
+	b.failure(host, now)
+	if until := b.stats()[host].OpenUntil; !until.Equal(now.Add(2 * time.Second)) {
+		t.Fatalf("expected doubled cooldown, got: %s", until.Sub(now))
+	}
+
+	if cooldown := b.backoff(5); cooldown != b.maxCooldown {
+		t.Fatalf("expected cooldown to be capped at %s, got: %s", b.maxCooldown, cooldown)
+	}
+
+	b.success(host)
+	if err = b.allow(host, now); err != nil {
+		t.Fatalf("breaker should be closed after success, got: %s", err)
+	}
+}
@@ -0,0 +1,89 @@
+package sshmgr
+
+import (
+	"context"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+)
+
+var (
+	// errCheckFileUnsupported is returned when the server does not advertise check-file
+	errCheckFileUnsupported = errors.New("check-file extension unsupported")
+
+	// errCheckFileAlgorithm is returned when the server does not compute check-file
+	// digests with the requested algorithm
+	errCheckFileAlgorithm = errors.New("check-file algorithm unsupported")
+)
+
+// checkFile computes the checksums of the remote paths on the server with the
+// check-file sftp extension
+func (c *Client) checkFile(ctx context.Context, paths []string, algo HashAlgorithm) (sums map[string]string, err error) {
+	err = c.rawSFTP(ctx, func(conn *rawSFTPConn) (err error) {
+		if !conn.supports("check-file") && !conn.supports("check-file-name") {
+			return errCheckFileUnsupported
+		}
+
+		sums = make(map[string]string, len(paths))
+		for _, p := range paths {
+			if sums[p], err = conn.hash(p, algo); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+
+	if errors.Is(err, ErrSFTPUnavailable) {
+		return nil, fmt.Errorf("%w: %w", errCheckFileUnsupported, err)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return sums, nil
+}
+
+// hash requests the checksum of the whole file name
+func (c *rawSFTPConn) hash(name string, algo HashAlgorithm) (sum string, err error) {
+	req := appendString(nil, "check-file-name")
+	req = appendString(req, name)
+	req = appendString(req, string(algo))
+	req = binary.BigEndian.AppendUint64(req, 0) // start offset
+	req = binary.BigEndian.AppendUint64(req, 0) // length, to the end of file
+	req = binary.BigEndian.AppendUint32(req, 0) // block size, a single block
+
+	typ, reply, err := c.request(sshFxpExtended, req)
+	if err != nil {
+		return "", err
+	}
+
+	switch typ {
+	case sshFxpStatus:
+		if len(reply) >= 4 && binary.BigEndian.Uint32(reply) == sshFxOpUnsupported {
+			return "", fmt.Errorf("%w: %s", errCheckFileAlgorithm, algo)
+		}
+		if err = c.status("check-file", name, reply); err == nil {
+			err = errors.New("sftp: check-file without digest")
+		}
+		return "", err
+
+	case sshFxpExtendedReply:
+		_, rest, ok := parseString(reply)
+		if !ok {
+			return "", errors.New("sftp: short check-file reply")
+		}
+		used, digest, ok := parseString(rest)
+		if !ok || len(digest) == 0 {
+			return "", errors.New("sftp: short check-file reply")
+		}
+
+		// Servers may pick another algorithm when the requested one is unsupported
+		if used != string(algo) {
+			return "", fmt.Errorf("%w: %s digests not available", errCheckFileAlgorithm, algo)
+		}
+		return hex.EncodeToString(digest), nil
+
+	default:
+		return "", fmt.Errorf("sftp: unexpected packet type %d", typ)
+	}
+}
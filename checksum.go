@@ -0,0 +1,288 @@
+package sshmgr
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"log/slog"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+)
+
+// maxChecksumArgs bounds the length of the file arguments of a remote checksum command
+const maxChecksumArgs = 64 << 10
+
+// HashAlgorithm is a file checksum algorithm
+type HashAlgorithm string
+
+const (
+	// SHA256 is the sha256 checksum algorithm
+	SHA256 HashAlgorithm = "sha256"
+	// MD5 is the md5 checksum algorithm
+	MD5 HashAlgorithm = "md5"
+)
+
+// hashCommands compute the checksums of the files given as arguments with the
+// coreutils command or its BSD equivalent, whichever is available on the remote host
+var hashCommands = map[HashAlgorithm]string{
+	SHA256: `f() { if command -v sha256sum >/dev/null 2>&1; then sha256sum -- "$@"; ` +
+		`else shasum -a 256 -- "$@"; fi; }; f`,
+	MD5: `f() { if command -v md5sum >/dev/null 2>&1; then md5sum -- "$@"; ` +
+		`else md5 -r -- "$@"; fi; }; f`,
+}
+
+// newHash returns a hash for algo
+func newHash(algo HashAlgorithm) (h hash.Hash, err error) {
+	switch algo {
+	case SHA256:
+		return sha256.New(), nil
+	case MD5:
+		return md5.New(), nil
+	default:
+		return nil, fmt.Errorf("unsupported hash algorithm %q", algo)
+	}
+}
+
+// ChecksumMismatchError is returned by verified transfers when the checksum
+// of a transferred file differs from the checksum of its source
+type ChecksumMismatchError struct {
+	// Path is the destination file path
+	Path string
+	// Algorithm is the checksum algorithm
+	Algorithm HashAlgorithm
+	// Expected is the hex checksum of the source file
+	Expected string
+	// Actual is the hex checksum of the destination file
+	Actual string
+}
+
+func (e *ChecksumMismatchError) Error() string {
+	return fmt.Sprintf("%s: %s checksum mismatch, expected %s, got %s", e.Path, e.Algorithm, e.Expected, e.Actual)
+}
+
+// Checksum returns the hex checksum of the remote file name, see Checksums
+func (c *Client) Checksum(ctx context.Context, name string, algo HashAlgorithm) (sum string, err error) {
+	sums, err := c.Checksums(ctx, []string{name}, algo)
+	if err != nil {
+		return "", err
+	}
+	return sums[name], nil
+}
+
+// Checksums returns the hex checksums of the remote files by path. Checksums are
+// computed by the server with the check-file sftp extension when supported, or by
+// running sha256sum, shasum, md5sum or md5 on the remote host. Files are never
+// read over the connection
+func (c *Client) Checksums(ctx context.Context, names []string, algo HashAlgorithm) (sums map[string]string, err error) {
+	ctx, span := c.tracer.Start(ctx, "sshmgr.checksum", c.attrs...)
+	defer func() { endSpan(span, err) }()
+
+	if _, err = newHash(algo); err != nil {
+		return nil, err
+	}
+
+	// Servers without check-file or without the algorithm are not probed again
+	if atomic.LoadInt32(&c.nocheck) == 0 && c.checkFileHash(algo) {
+		if sums, err = c.checkFile(ctx, names, algo); err == nil {
+			return sums, nil
+		}
+
+		switch {
+		case errors.Is(err, errCheckFileAlgorithm):
+			c.cmtx.Lock()
+			if c.nohash == nil {
+				c.nohash = make(map[HashAlgorithm]bool)
+			}
+			c.nohash[algo] = true
+			c.cmtx.Unlock()
+		case errors.Is(err, errCheckFileUnsupported):
+			atomic.StoreInt32(&c.nocheck, 1)
+		default:
+			return nil, err
+		}
+		c.log.Debug("check-file unsupported, using checksum commands", slog.Any("error", err))
+	}
+
+	return c.remoteHashes(ctx, names, algo)
+}
+
+// checkFileHash reports whether check-file digests with algo were not found unsupported by the server
+func (c *Client) checkFileHash(algo HashAlgorithm) (ok bool) {
+	c.cmtx.Lock()
+	defer c.cmtx.Unlock()
+	return !c.nohash[algo]
+}
+
+// Checksum returns the hex checksum of the remote file name, see Client.Checksums
+func (s *SFTPClient) Checksum(ctx context.Context, name string, algo HashAlgorithm) (sum string, err error) {
+	return s.client.Checksum(ctx, name, algo)
+}
+
+// remoteHashes computes the hex checksums of the remote paths by running the checksum
+// commands on the remote host, in batches bounded by maxChecksumArgs
+func (c *Client) remoteHashes(ctx context.Context, paths []string, algo HashAlgorithm) (sums map[string]string, err error) {
+	sums = make(map[string]string, len(paths))
+
+	for len(paths) > 0 {
+		var args strings.Builder
+		n := 0
+		for ; n < len(paths) && (n == 0 || args.Len()+len(paths[n]) < maxChecksumArgs); n++ {
+			args.WriteString(" ")
+			args.WriteString(shellQuote(paths[n]))
+		}
+
+		out, err := c.output(ctx, hashCommands[algo]+args.String())
+		if err != nil {
+			return nil, err
+		}
+
+		for p, sum := range parseChecksums(out) {
+			sums[p] = sum
+		}
+		paths = paths[n:]
+	}
+
+	return sums, nil
+}
+
+// parseChecksums parses the output of coreutils style checksum commands, lines holding
+// the hex digest, a separator and the file name, escaped if prefixed with a backslash
+func parseChecksums(out []byte) (sums map[string]string) {
+	sums = map[string]string{}
+	scanner := bufio.NewScanner(bytes.NewReader(out))
+	scanner.Buffer(nil, 1<<20)
+
+	for scanner.Scan() {
+		line := scanner.Text()
+		escaped := strings.HasPrefix(line, `\`)
+		if escaped {
+			line = line[1:]
+		}
+
+		i := strings.IndexByte(line, ' ')
+		if i < 0 || len(line) < i+2 {
+			continue
+		}
+
+		// The coreutils separator is a space and a space or asterisk, BSD md5 -r uses a single space
+		sum, name := line[:i], line[i+1:]
+		if name[0] == ' ' || name[0] == '*' {
+			name = name[1:]
+		}
+
+		if escaped {
+			name = strings.NewReplacer(`\\`, `\`, `\n`, "\n", `\r`, "\r").Replace(name)
+		}
+		sums[name] = strings.ToLower(sum)
+	}
+	return sums
+}
+
+// readerHash returns the hex checksum of the contents of r
+func readerHash(r io.Reader, algo HashAlgorithm) (sum string, err error) {
+	h, err := newHash(algo)
+	if err != nil {
+		return "", err
+	}
+
+	if _, err = io.Copy(h, r); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// readerSHA256 returns the sha256 hex digest of the contents of r
+func readerSHA256(r io.Reader) (sum string, err error) {
+	return readerHash(r, SHA256)
+}
+
+// fileSHA256 returns the sha256 hex digest of the local file name
+func fileSHA256(name string) (sum string, err error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	return readerSHA256(f)
+}
+
+// verifiedFile is a transferred file to verify
+type verifiedFile struct {
+	local, remote string
+}
+
+// verifiedFiles returns the local and remote files of copied transfer jobs
+func verifiedFiles(jobs []transferJob, upload bool) (files []verifiedFile) {
+	for _, job := range jobs {
+		if upload {
+			files = append(files, verifiedFile{local: job.src, remote: job.dst})
+		} else {
+			files = append(files, verifiedFile{local: job.dst, remote: job.src})
+		}
+	}
+	return files
+}
+
+// verifiedTree returns the files at the slash separated paths rels relative to
+// the local and remote roots, an empty path being the root itself
+func verifiedTree(local, remote string, rels []string) (files []verifiedFile) {
+	for _, rel := range rels {
+		files = append(files, verifiedFile{
+			local:  filepath.Join(local, filepath.FromSlash(rel)),
+			remote: path.Join(remote, rel),
+		})
+	}
+	return files
+}
+
+// verify compares the sha256 checksums of transferred local and remote files,
+// failing with a *ChecksumMismatchError for the first differing file
+func (c *Client) verify(ctx context.Context, files []verifiedFile, upload bool) (err error) {
+	if len(files) == 0 {
+		return nil
+	}
+
+	remotes := make([]string, len(files))
+	for i, f := range files {
+		remotes[i] = f.remote
+	}
+
+	sums, err := c.Checksums(ctx, remotes, SHA256)
+	if err != nil {
+		return fmt.Errorf("verify: %w", err)
+	}
+
+	for _, f := range files {
+		if err = ctx.Err(); err != nil {
+			return err
+		}
+
+		local, err := fileSHA256(f.local)
+		if err != nil {
+			return fmt.Errorf("verify: %w", err)
+		}
+
+		remote := sums[f.remote]
+		if local == remote {
+			continue
+		}
+
+		if upload {
+			return &ChecksumMismatchError{Path: f.remote, Algorithm: SHA256, Expected: local, Actual: remote}
+		}
+		return &ChecksumMismatchError{Path: f.local, Algorithm: SHA256, Expected: remote, Actual: local}
+	}
+
+	c.log.Debug("transfer verified", slog.Int("files", len(files)))
+	return nil
+}
@@ -0,0 +1,229 @@
+package sshmgr
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestChecksums(t *testing.T) {
+	server := newTestServer(t)
+	manager := New(time.Minute, time.Minute)
+	defer manager.Close()
+
+	client, err := manager.SSHClient(server.clientConfig())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	dir := t.TempDir()
+	writeTree(t, dir, map[string]string{"a.txt": "a", "with space.txt": "b"})
+	names := []string{filepath.Join(dir, "a.txt"), filepath.Join(dir, "with space.txt")}
+
+	ctx := context.Background()
+	for _, algo := range []HashAlgorithm{SHA256, MD5} {
+		sums, err := client.Checksums(ctx, names, algo)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		for _, name := range names {
+			f, err := os.Open(name)
+			if err != nil {
+				t.Fatal(err)
+			}
+			expected, err := readerHash(f, algo)
+			f.Close()
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if sums[name] != expected {
+				t.Fatalf("%s: expected %s checksum %s, got %s", name, algo, expected, sums[name])
+			}
+		}
+	}
+
+	// The test server does not advertise check-file, so commands are used
+	if atomic.LoadInt32(&client.nocheck) != 1 {
+		t.Fatal("expected check-file to be unsupported")
+	}
+
+	if _, err = client.Checksum(ctx, names[0], "crc32"); err == nil {
+		t.Fatal("expected an unsupported algorithm to fail")
+	}
+}
+
+// serveCheckFile serves check-file requests on rw, replying with md5 digests
+// to requests for algos and for files named missing with a no such file status
+func serveCheckFile(rw io.ReadWriter, algos ...HashAlgorithm) {
+	server := &rawSFTPConn{r: rw, w: rw}
+	if _, _, err := server.recv(); err != nil {
+		return
+	}
+
+	version := binary.BigEndian.AppendUint32(nil, 3)
+	version = appendString(appendString(version, "check-file"), "1")
+	server.send(sshFxpVersion, version)
+
+	for {
+		_, req, err := server.recv()
+		if err != nil {
+			return
+		}
+
+		id := req[:4]
+		_, rest, _ := parseString(req[4:])
+		name, rest, _ := parseString(rest)
+		algo, _, _ := parseString(rest)
+
+		reply := append([]byte{}, id...)
+		if name == "missing" {
+			reply = binary.BigEndian.AppendUint32(reply, sshFxNoSuchFile)
+			server.send(sshFxpStatus, appendString(appendString(reply, "no such file"), ""))
+			continue
+		}
+
+		// Servers pick another algorithm when the requested one is unsupported
+		used := MD5
+		for _, a := range algos {
+			if string(a) == algo {
+				used = a
+			}
+		}
+		reply = appendString(appendString(reply, "check-file"), string(used))
+		server.send(sshFxpExtendedReply, append(reply, 0xde, 0xad, 0xbe, 0xef))
+	}
+}
+
+func TestCheckFileConn(t *testing.T) {
+	cc, sc := net.Pipe()
+	defer cc.Close()
+	defer sc.Close()
+	go serveCheckFile(sc, MD5)
+
+	conn := &rawSFTPConn{r: cc, w: cc}
+	if err := conn.init(); err != nil {
+		t.Fatal(err)
+	}
+
+	sum, err := conn.hash("a.txt", MD5)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sum != "deadbeef" {
+		t.Fatalf("expected checksum deadbeef, got %s", sum)
+	}
+
+	if _, err = conn.hash("missing", MD5); !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("expected a missing file error, got %v", err)
+	}
+
+	// Digests of another algorithm are not accepted
+	if _, err = conn.hash("a.txt", SHA256); !errors.Is(err, errCheckFileAlgorithm) {
+		t.Fatalf("expected the algorithm to be unsupported, got %v", err)
+	}
+}
+
+func TestCheckFileAlgorithms(t *testing.T) {
+	server := newTestServer(t)
+	server.sftpHandler = func(rw io.ReadWriter) { serveCheckFile(rw, MD5) }
+	manager := New(time.Minute, time.Minute)
+	defer manager.Close()
+
+	client, err := manager.SSHClient(server.clientConfig())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	dir := t.TempDir()
+	writeTree(t, dir, map[string]string{"a.txt": "a"})
+	name := filepath.Join(dir, "a.txt")
+	ctx := context.Background()
+
+	// Algorithms not supported by check-file fall back to checksum commands
+	sum, err := client.Checksum(ctx, name, SHA256)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f, err := os.Open(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected, err := readerHash(f, SHA256)
+	f.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sum != expected {
+		t.Fatalf("expected sha256 checksum %s, got %s", expected, sum)
+	}
+
+	// while check-file is still used for the algorithms it supports
+	for i := 0; i < 2; i++ {
+		if sum, err = client.Checksum(ctx, name, MD5); err != nil {
+			t.Fatal(err)
+		}
+		if sum != "deadbeef" {
+			t.Fatalf("expected the check-file md5 checksum, got %s", sum)
+		}
+	}
+
+	if atomic.LoadInt32(&client.nocheck) != 0 || !client.nohash[SHA256] || client.nohash[MD5] {
+		t.Fatalf("expected only sha256 to be unsupported, got %v", client.nohash)
+	}
+}
+
+func TestTransferVerify(t *testing.T) {
+	server := newTestServer(t)
+	manager := New(time.Minute, time.Minute)
+	defer manager.Close()
+
+	session, err := manager.SFTPClient(server.clientConfig())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer session.Close()
+
+	src := t.TempDir()
+	writeTree(t, src, map[string]string{"a.txt": "a", "sub/b.txt": "b"})
+
+	ctx := context.Background()
+	remote := filepath.Join(t.TempDir(), "remote")
+	if err = session.Upload(ctx, src, remote, TransferOptions{Verify: true}); err != nil {
+		t.Fatal(err)
+	}
+
+	local := filepath.Join(t.TempDir(), "local")
+	if err = session.Download(ctx, remote, local, TransferOptions{Verify: true}); err != nil {
+		t.Fatal(err)
+	}
+	assertTree(t, local, map[string]string{"a.txt": "a", "sub/b.txt": "b"})
+
+	if err = session.UploadFile(ctx, filepath.Join(src, "a.txt"), filepath.Join(remote, "c.txt"), ChunkedOptions{Verify: true}); err != nil {
+		t.Fatal(err)
+	}
+
+	// A remote file changed after the transfer fails the verification
+	if err = os.WriteFile(filepath.Join(remote, "a.txt"), []byte("changed"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	files := []verifiedFile{{local: filepath.Join(src, "a.txt"), remote: filepath.Join(remote, "a.txt")}}
+	var mismatch *ChecksumMismatchError
+	if err = session.client.verify(ctx, files, true); !errors.As(err, &mismatch) {
+		t.Fatalf("expected a checksum mismatch, got %v", err)
+	}
+	if mismatch.Path != files[0].remote || mismatch.Algorithm != SHA256 || mismatch.Expected == mismatch.Actual {
+		t.Fatalf("unexpected mismatch %+v", mismatch)
+	}
+}
@@ -0,0 +1,398 @@
+package sshmgr
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/sftp"
+)
+
+const (
+	// defaultChunkSize is the size of the chunks files are split into
+	defaultChunkSize = 4 << 20
+
+	// defaultChunkConcurrency is the number of chunks transferred concurrently
+	defaultChunkConcurrency = 4
+)
+
+// ChunkedOptions configures chunked file transfers
+type ChunkedOptions struct {
+	// ChunkSize is the size of the chunks the file is split into, defaults to 4MiB
+	ChunkSize int64
+
+	// Concurrency is the number of chunks transferred concurrently, defaults to 4
+	Concurrency int
+
+	// Resume keeps the chunks of an existing destination file matching the source,
+	// compared by their sha256 digest, and transfers only the remaining chunks
+	Resume bool
+
+	// RateLimit bounds the bandwidth of the transfer in bytes per second,
+	// in addition to the manager limit set with WithRateLimit. Unlimited if zero
+	RateLimit int64
+
+	// Progress is called as data is transferred, calls are serialized
+	Progress func(progress TransferProgress)
+
+	// Verify compares the sha256 checksums of the whole source and destination
+	// files once the transfer completes, failing with a *ChecksumMismatchError
+	// if they differ
+	Verify bool
+}
+
+// TransferProgress reports the progress of a transfer
+type TransferProgress struct {
+	// Path is the source path of the file being transferred
+	Path string
+	// Bytes is the number of bytes transferred, including resumed chunks
+	Bytes int64
+	// Total is the number of bytes to transfer, zero if unknown
+	Total int64
+	// Rate is the average transfer rate in bytes per second, excluding resumed chunks
+	Rate float64
+	// ETA is the estimated time remaining, zero if unknown
+	ETA time.Duration
+}
+
+// UploadFile copies the local file to remote in chunks transferred concurrently.
+// Each chunk is retried on a dead transport in the resilient client mode, and a
+// failed transfer can be resumed with the Resume option
+func (s *SFTPClient) UploadFile(ctx context.Context, local, remote string, options ChunkedOptions) (err error) {
+	ctx, span := s.client.tracer.Start(ctx, "sshmgr.sftp.upload_file", s.client.attrs...)
+	defer func() { endSpan(span, err) }()
+
+	if err = s.chunked(ctx, localStore{}, &remoteStore{s}, local, remote, options); err != nil || !options.Verify {
+		return err
+	}
+	return s.client.verify(ctx, []verifiedFile{{local: local, remote: remote}}, true)
+}
+
+// DownloadFile copies the remote file to local in chunks transferred concurrently.
+// Each chunk is retried on a dead transport in the resilient client mode, and a
+// failed transfer can be resumed with the Resume option
+func (s *SFTPClient) DownloadFile(ctx context.Context, remote, local string, options ChunkedOptions) (err error) {
+	ctx, span := s.client.tracer.Start(ctx, "sshmgr.sftp.download_file", s.client.attrs...)
+	defer func() { endSpan(span, err) }()
+
+	if err = s.chunked(ctx, &remoteStore{s}, localStore{}, remote, local, options); err != nil || !options.Verify {
+		return err
+	}
+	return s.client.verify(ctx, []verifiedFile{{local: local, remote: remote}}, false)
+}
+
+// chunkStore is one side of a chunked transfer
+type chunkStore interface {
+	size(name string) (int64, error)
+	openRead(name string) (io.ReadSeekCloser, error)
+	openWrite(name string) (writeSeekCloser, error)
+	truncate(name string, size int64) error
+	sums(ctx context.Context, name string, chunk int64, count int) ([]string, error)
+}
+
+type writeSeekCloser interface {
+	io.WriteSeeker
+	io.Closer
+}
+
+// chunked copies src to dst in chunks
+func (s *SFTPClient) chunked(ctx context.Context, src, dst chunkStore, srcPath, dstPath string,
+	options ChunkedOptions) (err error) {
+
+	total, err := src.size(srcPath)
+	if err != nil {
+		return err
+	}
+
+	chunk := options.ChunkSize
+	if chunk <= 0 {
+		chunk = defaultChunkSize
+	}
+
+	workers := options.Concurrency
+	if workers <= 0 {
+		workers = defaultChunkConcurrency
+	}
+
+	count := int((total + chunk - 1) / chunk)
+	progress := newProgressTracker(options.Progress, srcPath, total)
+	limits := s.client.mgr.limiters(options.RateLimit)
+
+	done := make([]bool, count)
+	if options.Resume {
+		if done, err = s.resumable(ctx, src, dst, srcPath, dstPath, total, chunk, count); err != nil {
+			return err
+		}
+	} else if err = s.prepare(dst, dstPath); err != nil {
+		return err
+	}
+
+	var pending []int
+	for i := range done {
+		if done[i] {
+			progress.skip(chunkLength(i, chunk, total))
+			continue
+		}
+		pending = append(pending, i)
+	}
+
+	s.client.log.Debug("chunked transfer started", slog.String("src", srcPath), slog.String("dst", dstPath),
+		slog.Int("chunks", count), slog.Int("pending", len(pending)))
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	jobs := make(chan int)
+	var wg sync.WaitGroup
+	var once sync.Once
+	fail := func(ferr error) {
+		once.Do(func() {
+			err = ferr
+			cancel()
+		})
+	}
+
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range jobs {
+				offset, length := int64(i)*chunk, chunkLength(i, chunk, total)
+				cerr := s.connection().retry(ctx, "sftp.chunk", func() error {
+					m := &meter{ctx: ctx, limits: limits, progress: progress, path: srcPath}
+					return copyChunk(m, src, dst, srcPath, dstPath, offset, length)
+				})
+				if cerr != nil {
+					fail(fmt.Errorf("chunk %d: %w", i, cerr))
+				}
+			}
+		}()
+	}
+
+queue:
+	for _, i := range pending {
+		select {
+		case jobs <- i:
+		case <-ctx.Done():
+			break queue
+		}
+	}
+	close(jobs)
+	wg.Wait()
+
+	if err != nil {
+		return err
+	}
+
+	if err = ctx.Err(); err != nil {
+		return err
+	}
+
+	// The destination may be larger than the source when resuming
+	return dst.truncate(dstPath, total)
+}
+
+// prepare creates or empties the destination file
+func (s *SFTPClient) prepare(dst chunkStore, name string) (err error) {
+	w, err := dst.openWrite(name)
+	if err != nil {
+		return err
+	}
+	w.Close()
+	return dst.truncate(name, 0)
+}
+
+// resumable returns the chunks already present at the destination,
+// comparing the digests of the chunks overlapping the existing destination file
+func (s *SFTPClient) resumable(ctx context.Context, src, dst chunkStore, srcPath, dstPath string,
+	total, chunk int64, count int) (done []bool, err error) {
+
+	done = make([]bool, count)
+	size, err := dst.size(dstPath)
+	if errors.Is(err, os.ErrNotExist) || size == 0 {
+		return done, s.prepare(dst, dstPath)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	n := int((min(size, total) + chunk - 1) / chunk)
+	srcSums, err := src.sums(ctx, srcPath, chunk, n)
+	if err != nil {
+		return nil, err
+	}
+
+	dstSums, err := dst.sums(ctx, dstPath, chunk, n)
+	if err != nil {
+		return nil, err
+	}
+
+	resumed := 0
+	for i := 0; i < n; i++ {
+		if done[i] = srcSums[i] == dstSums[i]; done[i] {
+			resumed++
+		}
+	}
+
+	s.client.log.Info("resuming transfer", slog.String("dst", dstPath),
+		slog.Int("chunks", count), slog.Int("resumed", resumed))
+	return done, nil
+}
+
+// chunkLength returns the length of chunk i of a file of size total
+func chunkLength(i int, chunk, total int64) (length int64) {
+	return min(chunk, total-int64(i)*chunk)
+}
+
+// copyChunk copies length bytes at offset from src to dst through the meter m
+func copyChunk(m *meter, src, dst chunkStore, srcPath, dstPath string, offset, length int64) (err error) {
+
+	r, err := src.openRead(srcPath)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+
+	w, err := dst.openWrite(dstPath)
+	if err != nil {
+		return err
+	}
+
+	if _, err = r.Seek(offset, io.SeekStart); err == nil {
+		_, err = w.Seek(offset, io.SeekStart)
+	}
+
+	var n int64
+	if err == nil {
+		n, err = io.Copy(w, m.reader(io.LimitReader(r, length)))
+		if err == nil && n != length {
+			err = io.ErrUnexpectedEOF
+		}
+
+		// Retried chunks are accounted again from the start
+		if err != nil {
+			m.progress.add("", -m.n.Load())
+		}
+	}
+
+	if cerr := w.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// localStore is the local side of chunked transfers
+type localStore struct{}
+
+func (localStore) size(name string) (size int64, err error) {
+	info, err := os.Stat(name)
+	if err != nil {
+		return 0, err
+	}
+	return info.Size(), nil
+}
+
+func (localStore) openRead(name string) (io.ReadSeekCloser, error) {
+	return os.Open(name)
+}
+
+func (localStore) openWrite(name string) (writeSeekCloser, error) {
+	return os.OpenFile(name, os.O_WRONLY|os.O_CREATE, 0644)
+}
+
+func (localStore) truncate(name string, size int64) error {
+	return os.Truncate(name, size)
+}
+
+func (localStore) sums(ctx context.Context, name string, chunk int64, count int) (sums []string, err error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return chunkSums(ctx, f, chunk, count)
+}
+
+// remoteStore is the remote side of chunked transfers
+type remoteStore struct {
+	s *SFTPClient
+}
+
+func (r *remoteStore) size(name string) (size int64, err error) {
+	info, err := r.s.Stat(name)
+	if err != nil {
+		return 0, err
+	}
+	return info.Size(), nil
+}
+
+func (r *remoteStore) openRead(name string) (io.ReadSeekCloser, error) {
+	return r.s.Open(name)
+}
+
+func (r *remoteStore) openWrite(name string) (w writeSeekCloser, err error) {
+	err = (&remoteFS{r.s}).do(func(client *sftp.Client) (err error) {
+		w, err = client.OpenFile(name, os.O_WRONLY|os.O_CREATE)
+		return err
+	})
+	return w, err
+}
+
+func (r *remoteStore) truncate(name string, size int64) (err error) {
+	return (&remoteFS{r.s}).do(func(client *sftp.Client) error {
+		return client.Truncate(name, size)
+	})
+}
+
+// chunkSumsCommand prints the sha256 of each chunk of a file
+// with sha256sum or shasum, whichever is available on the remote host
+const chunkSumsCommand = `f=%s; c=%d; n=%d; i=0; ` +
+	`if command -v sha256sum >/dev/null 2>&1; then h=sha256sum; else h="shasum -a 256"; fi; ` +
+	`while [ $i -lt $n ]; do dd if="$f" bs=$c skip=$i count=1 2>/dev/null | $h || exit 1; i=$((i+1)); done`
+
+// sums computes the chunk digests on the remote host,
+// or by reading the chunks over sftp if no checksum command is available
+func (r *remoteStore) sums(ctx context.Context, name string, chunk int64, count int) (sums []string, err error) {
+	out, err := r.s.client.output(ctx, fmt.Sprintf(chunkSumsCommand, shellQuote(name), chunk, count))
+	if err == nil {
+		scanner := bufio.NewScanner(bytes.NewReader(out))
+		for scanner.Scan() {
+			if fields := strings.Fields(scanner.Text()); len(fields) > 0 {
+				sums = append(sums, strings.ToLower(fields[0]))
+			}
+		}
+
+		if len(sums) == count {
+			return sums, nil
+		}
+		err = fmt.Errorf("expected %d chunk checksums, got %d", count, len(sums))
+	}
+	r.s.client.log.Warn("remote chunk checksums failed, reading chunks over sftp", slog.Any("error", err))
+
+	f, err := r.s.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return chunkSums(ctx, f, chunk, count)
+}
+
+// chunkSums returns the sha256 digests of the first count chunks of r
+func chunkSums(ctx context.Context, r io.Reader, chunk int64, count int) (sums []string, err error) {
+	for i := 0; i < count; i++ {
+		sum, err := readerSHA256((&meter{ctx: ctx}).reader(io.LimitReader(r, chunk)))
+		if err != nil {
+			return nil, err
+		}
+		sums = append(sums, sum)
+	}
+	return sums, nil
+}
@@ -0,0 +1,82 @@
+package sshmgr
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestChunkedTransfer(t *testing.T) {
+	server := newTestServer(t)
+	manager := New(time.Minute, time.Minute)
+	defer manager.Close()
+
+	session, err := manager.SFTPClient(server.clientConfig())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer session.Close()
+
+	data := make([]byte, 100<<10+123)
+	rand.Read(data)
+
+	dir := t.TempDir()
+	local := filepath.Join(dir, "artifact")
+	if err = os.WriteFile(local, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	var last TransferProgress
+	options := ChunkedOptions{
+		ChunkSize:   16 << 10,
+		Concurrency: 3,
+		Progress:    func(p TransferProgress) { last = p },
+	}
+
+	remote := filepath.Join(dir, "remote")
+	ctx := context.Background()
+	if err = session.UploadFile(ctx, local, remote, options); err != nil {
+		t.Fatal(err)
+	}
+	assertFile(t, remote, data)
+
+	if last.Bytes != int64(len(data)) || last.Total != int64(len(data)) {
+		t.Fatalf("unexpected final progress: %+v", last)
+	}
+
+	// Resume a partial download with a corrupted chunk and trailing garbage
+	partial := append(append([]byte{}, data[:40<<10]...), make([]byte, 100<<10)...)
+	partial[20<<10] ^= 0xff
+	downloaded := filepath.Join(dir, "downloaded")
+	if err = os.WriteFile(downloaded, partial, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	var progress []int64
+	options.Resume = true
+	options.Progress = func(p TransferProgress) { progress = append(progress, p.Bytes) }
+	if err = session.DownloadFile(ctx, remote, downloaded, options); err != nil {
+		t.Fatal(err)
+	}
+	assertFile(t, downloaded, data)
+
+	// The first and third 16KiB chunks are kept, the second was corrupted
+	if progress[0] != 16<<10 || progress[1] != 32<<10 {
+		t.Fatalf("expected two resumed chunks, got progress: %v", progress[:2])
+	}
+}
+
+func assertFile(t *testing.T, name string, expected []byte) {
+	data, err := os.ReadFile(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !bytes.Equal(data, expected) {
+		t.Fatalf("%s: expected %d bytes, got %d different bytes", name, len(expected), len(data))
+	}
+}
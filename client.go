@@ -1,13 +1,18 @@
 package sshmgr
 
 import (
+	"bytes"
+	"context"
 	"errors"
+	"fmt"
 	"io"
+	"log/slog"
 	"net"
+	"strings"
+	"sync"
 	"sync/atomic"
 	"time"
 
-	"github.com/pkg/sftp"
 	"golang.org/x/crypto/ssh"
 )
 
@@ -17,10 +22,30 @@ var (
 
 // Client is a shared managed ssh client
 type Client struct {
-	client *ssh.Client
-	conn   net.Conn
-	atime  int64
-	refs   int32
+	mtx      sync.RWMutex
+	client   *ssh.Client
+	conn     net.Conn
+	atime    int64
+	refs     int32
+	sessions int32
+	alive    int64
+	log      *slog.Logger
+	tracer   Tracer
+	attrs    []slog.Attr
+	mgr      *Manager
+	id       string
+	addr     string
+	config   ClientConfig
+	closed   bool
+	err      error
+	done     chan struct{}
+	algos    Algorithms
+	smtx     sync.Mutex
+	sftps    []*sftpSession
+	nocheck  int32
+	nofsync  int32
+	cmtx     sync.Mutex
+	nohash   map[HashAlgorithm]bool
 }
 
 // Close notifies the manager that this client can be removed
@@ -35,61 +60,442 @@ func (c *Client) Close() (err error) {
 	return nil
 }
 
+// close the underlying connection and release its connection slot
+func (c *Client) close() (err error) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+
+	if c.closed {
+		return c.err
+	}
+
+	c.closed = true
+	close(c.done)
+	c.err = c.client.Close()
+	c.mgr.limits.releaseConn(c.addr)
+	return c.err
+}
+
+// transport returns the current ssh connection and the channel closed when it is closed
+func (c *Client) transport() (client *ssh.Client, done chan struct{}) {
+	c.mtx.RLock()
+	defer c.mtx.RUnlock()
+	return c.client, c.done
+}
+
+// setDeadline sets the deadline of the current network connection,
+// a zero duration leaves the connection without a deadline
+func (c *Client) setDeadline(d time.Duration) {
+	if d <= 0 {
+		return
+	}
+
+	c.mtx.RLock()
+	c.conn.SetDeadline(time.Now().Add(d))
+	c.mtx.RUnlock()
+}
+
+// start watches the current transport and starts keepalives if enabled
+func (c *Client) start() {
+	client, done := c.transport()
+	go c.watch(client, done)
+	if c.mgr.health.Interval > 0 {
+		go c.keepalive(client, done)
+	}
+}
+
+// discard removes the client from the manager and closes it,
+// unless the transport identified by done was already replaced
+func (c *Client) discard(done chan struct{}) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+
+	if c.done != done || c.closed {
+		return
+	}
+
+	c.mgr.delClient(c)
+	c.closed = true
+	close(c.done)
+	c.err = c.client.Close()
+	c.mgr.limits.releaseConn(c.addr)
+}
+
+// isClosed reports whether the current transport was closed
+func (c *Client) isClosed() (closed bool) {
+	c.mtx.RLock()
+	defer c.mtx.RUnlock()
+	return c.closed
+}
+
 // CombinedOutput runs cmd on the remote host and returns its combined
 // standard output and standard error.
 func (c *Client) CombinedOutput(cmd string, envs map[string]string) (data []byte, err error) {
-	s, err := c.client.NewSession()
+	return c.CombinedOutputContext(context.Background(), cmd, envs)
+}
+
+// CombinedOutputContext is like CombinedOutput but the remote command
+// is killed and its session closed if ctx is done before it completes
+func (c *Client) CombinedOutputContext(ctx context.Context, cmd string, envs map[string]string) (data []byte, err error) {
+	ctx, span := c.tracer.Start(ctx, "sshmgr.exec", c.attrs...)
+	defer func() { endSpan(span, err) }()
+
+	s, err := c.newSession(ctx, envs)
 	if err != nil {
 		return nil, err
 	}
 	defer s.Close()
 
-	for name := range envs {
-		if err = s.Setenv(name, envs[name]); err != nil {
-			return nil, err
-		}
-	}
+	c.log.Debug("running command", slog.String("cmd", cmd))
+	err = waitSession(ctx, s, func() (err error) {
+		data, err = s.CombinedOutput(cmd)
+		return err
+	})
+	span.SetAttributes(slog.Int("exit_status", exitStatus(err)), slog.Int("bytes", len(data)))
 
-	return s.CombinedOutput(cmd)
+	if err != nil {
+		c.log.Warn("command failed", slog.String("cmd", cmd), slog.Any("error", err))
+	}
+	return data, err
 }
 
+// readCloser streams the combined output of a started command, waiting
+// for the command and ending its span when closed
 type readCloser struct {
 	io.Reader
-	s *ssh.Session
+	pr    *io.PipeReader
+	s     *session
+	ctx   context.Context
+	stop  func() bool
+	span  Span
+	log   *slog.Logger
+	cmd   string
+	done  chan struct{}
+	err   error
+	bytes int64
+}
+
+func (r *readCloser) Read(p []byte) (n int, err error) {
+	n, err = r.Reader.Read(p)
+	r.bytes += int64(n)
+	return n, err
+}
+
+// Close waits for the command to exit and returns its error. Commands with
+// unread output are killed, as they may be blocked writing, and no error is returned
+func (r *readCloser) Close() (err error) {
+	select {
+	case <-r.done:
+		err = r.err
+	default:
+		r.s.Signal(ssh.SIGKILL)
+		r.s.Close()
+		r.pr.Close()
+		<-r.done
+	}
+
+	if !r.stop() {
+		err = r.ctx.Err()
+	}
+	r.s.Close()
+
+	r.span.SetAttributes(slog.Int("exit_status", exitStatus(err)), slog.Int64("bytes", r.bytes))
+	endSpan(r.span, err)
+	if err != nil {
+		r.log.Warn("command failed", slog.String("cmd", r.cmd), slog.Any("error", err))
+	}
+	return err
+}
+
+// output runs cmd on the remote host and returns its standard output,
+// with the standard error included in the returned error on failure
+func (c *Client) output(ctx context.Context, cmd string) (data []byte, err error) {
+	ctx, span := c.tracer.Start(ctx, "sshmgr.exec", c.attrs...)
+	defer func() { endSpan(span, err) }()
+
+	s, err := c.newSession(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer s.Close()
+
+	var stderr bytes.Buffer
+	s.Stderr = &stderr
+
+	c.log.Debug("running command", slog.String("cmd", cmd))
+	err = waitSession(ctx, s, func() (err error) {
+		data, err = s.Output(cmd)
+		return err
+	})
+	span.SetAttributes(slog.Int("exit_status", exitStatus(err)), slog.Int("bytes", len(data)))
+
+	if err != nil {
+		return data, fmt.Errorf("%w: %s", err, bytes.TrimSpace(stderr.Bytes()))
+	}
+	return data, nil
+}
+
+// exchange runs cmd on the remote host with fn writing its standard input and reading
+// its standard output, which is closed once fn returns. The command is killed if fn
+// fails, and its standard error is included in the returned error
+func (c *Client) exchange(ctx context.Context, cmd string, fn func(stdin io.Writer, stdout io.Reader) error) (err error) {
+	s, err := c.newSession(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer s.Close()
+
+	w, err := s.StdinPipe()
+	if err != nil {
+		return err
+	}
+
+	r, err := s.StdoutPipe()
+	if err != nil {
+		return err
+	}
+
+	var stderr bytes.Buffer
+	s.Stderr = &stderr
+
+	err = waitSession(ctx, s, func() (err error) {
+		if err = s.Start(cmd); err != nil {
+			return err
+		}
+
+		// The command is killed on failures as it may be blocked writing
+		if err = fn(w, r); err != nil {
+			s.Signal(ssh.SIGKILL)
+			s.Close()
+		}
+		w.Close()
+		if werr := s.Wait(); err == nil {
+			err = werr
+		}
+		return err
+	})
+
+	if msg := bytes.TrimSpace(stderr.Bytes()); err != nil && len(msg) > 0 {
+		err = fmt.Errorf("%w: %s", err, msg)
+	}
+	return err
 }
 
-func (r readCloser) Close() (err error) {
-	return r.s.Close()
+// shellQuote quotes s as a single word for POSIX shells
+func shellQuote(s string) (quoted string) {
+	return "'" + strings.ReplaceAll(s, "'", `'"'"'`) + "'"
 }
 
 // CombinedReader is like CombinedOutput but returns a io.Reader combining both stderr and stdout.
 func (c *Client) CombinedReader(cmd string, envs map[string]string) (reader io.ReadCloser, err error) {
-	s, err := c.client.NewSession()
+	return c.CombinedReaderContext(context.Background(), cmd, envs)
+}
+
+// CombinedReaderContext is like CombinedReader but the remote command
+// is killed and its session closed if ctx is done before it completes.
+// The output is streamed as the command runs and the command error is
+// returned when the reader is closed
+func (c *Client) CombinedReaderContext(ctx context.Context, cmd string, envs map[string]string) (reader io.ReadCloser, err error) {
+	ctx, span := c.tracer.Start(ctx, "sshmgr.exec", c.attrs...)
+	defer func() {
+		if err != nil {
+			endSpan(span, err)
+		}
+	}()
+
+	s, err := c.newSession(ctx, envs)
+	if err != nil {
+		return nil, err
+	}
+
+	// Both outputs are copied to the pipe by the session until the command exits
+	pr, pw := io.Pipe()
+	s.Stdout, s.Stderr = pw, pw
+
+	c.log.Debug("running command", slog.String("cmd", cmd))
+	if err = s.Start(cmd); err != nil {
+		c.log.Warn("command failed", slog.String("cmd", cmd), slog.Any("error", err))
+		s.Close()
+		return nil, err
+	}
+
+	m := &meter{ctx: ctx, limits: c.mgr.limiters(0)}
+	r := &readCloser{Reader: m.reader(pr), pr: pr, s: s, ctx: ctx, span: span,
+		log: c.log, cmd: cmd, done: make(chan struct{})}
+	r.stop = context.AfterFunc(ctx, func() {
+		s.Signal(ssh.SIGKILL)
+		s.Close()
+	})
+
+	go func() {
+		r.err = s.Wait()
+		pw.Close()
+		close(r.done)
+	}()
+	return r, nil
+}
+
+// StreamOptions configures Stream
+type StreamOptions struct {
+	// Env sets environment variables for the command
+	Env map[string]string
+
+	// Stdin is streamed to the command standard input if set
+	Stdin io.Reader
+
+	// Stdout and Stderr receive the command standard output and error if set
+	Stdout io.Writer
+	Stderr io.Writer
+
+	// RateLimit bounds the bandwidth of the standard input and output in bytes per second,
+	// in addition to the manager limit set with WithRateLimit. Unlimited if zero
+	RateLimit int64
+
+	// Progress is called as standard input and output data is streamed
+	Progress func(progress TransferProgress)
+}
+
+// Stream runs cmd on the remote host, streaming its standard input and output
+// with the bandwidth limits of options. The remote command is killed
+// and its session closed if ctx is done before it completes
+func (c *Client) Stream(ctx context.Context, cmd string, options StreamOptions) (err error) {
+	ctx, span := c.tracer.Start(ctx, "sshmgr.exec", c.attrs...)
+	defer func() { endSpan(span, err) }()
+
+	s, err := c.newSession(ctx, options.Env)
+	if err != nil {
+		return err
+	}
+	defer s.Close()
+
+	m := &meter{ctx: ctx, limits: c.mgr.limiters(options.RateLimit),
+		progress: newProgressTracker(options.Progress, cmd, 0)}
+	if options.Stdin != nil {
+		s.Stdin = m.reader(options.Stdin)
+	}
+	if options.Stdout != nil {
+		s.Stdout = m.writer(options.Stdout)
+	}
+	s.Stderr = options.Stderr
+
+	c.log.Debug("streaming command", slog.String("cmd", cmd))
+	err = waitSession(ctx, s, func() (err error) {
+		return s.Run(cmd)
+	})
+	span.SetAttributes(slog.Int("exit_status", exitStatus(err)), slog.Int64("bytes", m.n.Load()))
+
+	if err != nil {
+		c.log.Warn("command failed", slog.String("cmd", cmd), slog.Any("error", err))
+	}
+	return err
+}
+
+// session is a ssh session accounted on the pooled connection it was opened on
+type session struct {
+	*ssh.Session
+	conn *Client
+	once sync.Once
+}
+
+// Close the session and release its slot on the connection
+func (s *session) Close() (err error) {
+	err = s.Session.Close()
+	s.once.Do(s.conn.releaseSession)
+	return err
+}
+
+// newSession opens a session with the given environment variables set
+func (c *Client) newSession(ctx context.Context, envs map[string]string) (s *session, err error) {
+	ctx, span := c.tracer.Start(ctx, "sshmgr.session.open", c.attrs...)
+	defer func() { endSpan(span, err) }()
+
+	err = c.retry(ctx, "session.open", func() (err error) {
+		s, err = c.openSession(ctx)
+		return err
+	})
 	if err != nil {
 		return nil, err
 	}
 
 	for name := range envs {
 		if err = s.Setenv(name, envs[name]); err != nil {
+			c.log.Warn("setenv failed", slog.String("env", name), slog.Any("error", err))
+			s.Close()
 			return nil, err
 		}
 	}
 
-	stdout, err := s.StdoutPipe()
+	return s, nil
+}
+
+// openSession opens a session on this connection or a sibling if it is saturated
+func (c *Client) openSession(ctx context.Context) (s *session, err error) {
+	conn, err := c.sessionConn(ctx)
 	if err != nil {
 		return nil, err
 	}
 
-	stderr, err := s.StderrPipe()
+	sc, _ := conn.transport()
+	ss, err := sc.NewSession()
 	if err != nil {
+		conn.releaseSession()
+		conn.log.Error("session open failed", slog.Any("error", err))
 		return nil, err
 	}
 
-	if err = s.Run(cmd); err != nil {
-		return nil, err
+	return &session{Session: ss, conn: conn}, nil
+}
+
+// sessionConn returns the connection a new session should be opened on
+// with a session slot reserved and a reference held until releaseSession.
+// When this connection is saturated an idle sftp session is closed to free
+// a slot, otherwise a sibling connection in the pool is used
+func (c *Client) sessionConn(ctx context.Context) (conn *Client, err error) {
+	if c.reserveSession() || (c.expireSFTP(-1) > 0 && c.reserveSession()) {
+		c.incr()
+		return c, nil
+	}
+	return c.mgr.sibling(ctx, c)
+}
+
+// reserveSession reserves a session slot if the connection is below the session limit
+func (c *Client) reserveSession() (ok bool) {
+	max := int32(c.mgr.maxSessions)
+	for {
+		n := atomic.LoadInt32(&c.sessions)
+		if max > 0 && n >= max {
+			return false
+		}
+		if atomic.CompareAndSwapInt32(&c.sessions, n, n+1) {
+			return true
+		}
 	}
+}
+
+// releaseSession releases a session slot and the reference held by the session
+func (c *Client) releaseSession() {
+	atomic.AddInt32(&c.sessions, -1)
+	c.Close()
+}
 
-	return readCloser{Reader: io.MultiReader(stdout, stderr), s: s}, nil
+// load returns the number of open sessions and references on this connection
+func (c *Client) load() (n int32) {
+	return atomic.LoadInt32(&c.sessions) + c.refcount()
+}
+
+// waitSession runs fn until it returns or ctx is done,
+// in which case the remote process is killed and the session closed to unblock fn
+func waitSession(ctx context.Context, s *session, fn func() error) (err error) {
+	stop := context.AfterFunc(ctx, func() {
+		s.Signal(ssh.SIGKILL)
+		s.Close()
+	})
+
+	err = fn()
+	if !stop() {
+		return ctx.Err()
+	}
+	return err
 }
 
 func (c *Client) incr() (r int32) {
@@ -97,7 +503,10 @@ func (c *Client) incr() (r int32) {
 }
 
 func (c *Client) decr() (r int32) {
-	return atomic.AddInt32(&c.refs, -1)
+	if r = atomic.AddInt32(&c.refs, -1); r == 0 {
+		c.mgr.released()
+	}
+	return r
 }
 
 func (c *Client) updateAtime() {
@@ -108,47 +517,129 @@ func (c *Client) refcount() (r int32) {
 	return atomic.LoadInt32(&c.refs)
 }
 
-// SFTPClient type
+// SFTPClient is a handle on a sftp session shared from the pool of a managed client.
+// The session is replaced by one on the new transport when its connection
+// is reconnected in the resilient client mode. The sftp.Client is no longer
+// embedded as the session can be replaced, use the wrapped methods or Client
 type SFTPClient struct {
-	*sftp.Client
 	client *Client
+	sess   *sftpSession
+	once   sync.Once
+	mtx    sync.Mutex
 }
 
-// Close the session and notify the manager
+// Close returns the session to the pool and notifies the manager
 func (s *SFTPClient) Close() (err error) {
+	s.once.Do(func() {
+		s.mtx.Lock()
+		s.sess.release()
+		s.mtx.Unlock()
+	})
 	return s.client.Close()
 }
 
-// Lock overrides the original client channel lock (does nothing)
-func (s *SFTPClient) Lock() {
-}
-
-// Unlock overrides the original client channel lock (does nothing)
-func (s *SFTPClient) Unlock() {
-}
-
 // newClient creates a new ssh.Client from the given config
-func newClient(config ClientConfig) (client *Client, err error) {
-	if config.Port == "" {
-		config.Port = "22"
-	}
-	addr := config.NetAddr + ":" + config.Port
+func (m *Manager) newClient(ctx context.Context, config ClientConfig) (client *Client, err error) {
+	log := clientLogger(m.log, config)
+	attrs := configAttrs(config)
+	addr := config.addr()
 	sshConfig, err := newSSHClientConfig(config)
 	if err != nil {
+		log.Error("invalid client config", slog.Any("error", err))
+		m.breakers.abort(addr)
+		return nil, err
+	}
+
+	// Reserve a connection slot, the slot is released when the client
+	// is closed or if the connection can not be established
+	if err = m.limits.acquireConn(ctx, addr, m.evictIdle); err != nil {
+		m.breakers.abort(addr)
+		return nil, err
+	}
+	defer func() {
+		if err != nil {
+			m.limits.releaseConn(addr)
+		}
+	}()
+
+	if err = m.limits.acquireDial(ctx); err != nil {
+		m.breakers.abort(addr)
 		return nil, err
 	}
+	defer m.limits.releaseDial()
 
-	conn, err := net.DialTimeout("tcp", addr, config.DialTimeout)
+	log.Debug("dialing", slog.String("addr", addr))
+	dialCtx, dialSpan := m.tracer.Start(ctx, "sshmgr.dial", attrs...)
+	conn, err := m.dial(dialCtx, config, addr)
+	endSpan(dialSpan, err)
 	if err != nil {
+		log.Error("dial failed", slog.String("addr", addr), slog.Any("error", err))
+		m.hostFailure(ctx, addr)
 		return nil, err
 	}
-	c, chans, reqs, err := ssh.NewClientConn(conn, addr, sshConfig)
+
+	_, handshakeSpan := m.tracer.Start(ctx, "sshmgr.handshake", attrs...)
+	kc := &kexInitConn{Conn: conn}
+	c, chans, reqs, err := handshake(ctx, kc, addr, sshConfig)
+	algos := kc.algorithms()
+	handshakeSpan.SetAttributes(
+		slog.String("kex", algos.KeyExchange),
+		slog.String("cipher", algos.CipherClientServer),
+		slog.String("host_key", algos.HostKey))
+	endSpan(handshakeSpan, err)
 	if err != nil {
+		log.Error("handshake failed", slog.String("addr", addr), slog.Any("error", err))
+		conn.Close()
+		m.hostFailure(ctx, addr)
 		return nil, err
 	}
+	m.breakers.success(addr)
+
+	log.Debug("negotiated algorithms",
+		slog.String("kex", algos.KeyExchange),
+		slog.String("host_key", algos.HostKey),
+		slog.String("cipher", algos.CipherClientServer),
+		slog.String("mac", algos.MACClientServer))
 
 	client = &Client{}
 	client.conn = conn
+	client.algos = algos
 	client.client = ssh.NewClient(c, chans, reqs)
+	client.log = log
+	client.tracer = m.tracer
+	client.attrs = attrs
+	client.mgr = m
+	client.id = config.id()
+	client.addr = addr
+	client.config = config
+	client.done = make(chan struct{})
+	client.markAlive()
 	return client, nil
 }
+
+// hostFailure records a dial or handshake failure on the host circuit breaker,
+// unless the attempt was aborted by the caller context
+func (m *Manager) hostFailure(ctx context.Context, addr string) {
+	if ctx.Err() != nil {
+		m.breakers.abort(addr)
+		return
+	}
+	m.breakers.failure(addr, time.Now())
+}
+
+// handshake establishes a ssh connection over conn, aborting if ctx is done
+func handshake(ctx context.Context, conn net.Conn, addr string, config *ssh.ClientConfig) (
+	c ssh.Conn, chans <-chan ssh.NewChannel, reqs <-chan *ssh.Request, err error) {
+
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+		defer conn.SetDeadline(time.Time{})
+	}
+
+	stop := context.AfterFunc(ctx, func() { conn.Close() })
+	c, chans, reqs, err = ssh.NewClientConn(conn, addr, config)
+	if !stop() {
+		return nil, nil, nil, ctx.Err()
+	}
+	return c, chans, reqs, err
+}
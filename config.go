@@ -2,7 +2,9 @@ package sshmgr
 
 import (
 	"fmt"
+	"net"
 	"strconv"
+	"strings"
 	"time"
 
 	"github.com/cespare/xxhash"
@@ -11,11 +13,12 @@ import (
 
 // ClientConfig parameters for getting ssh or sftp clients from the manager
 type ClientConfig struct {
-	// NetAddr specifies the host ip or name
+	// NetAddr specifies the host ip or name. It may include the port
+	// in the "host:port" or "[ipv6]:port" forms
 	NetAddr string
 
 	// Port specifies the host port to connect to.
-	// Defaults to 22 if empty
+	// Defaults to the NetAddr port if present or to 22 if empty
 	Port string
 
 	// User to authenticate as
@@ -34,17 +37,119 @@ type ClientConfig struct {
 	// Deadline to be used in the underlying net.Conn.
 	// Specified as a time.Duration so its set as the sum of the current time
 	// and the ConnDeadline when the connection is established or to upgrade the
-	// deadline when reusing a client
+	// deadline when reusing a client. No deadline is set if zero
 	ConnDeadline time.Duration
 
 	// DialTimeout
 	DialTimeout time.Duration
+
+	// Algorithms selects the profile of algorithms offered in negotiation.
+	// Defaults to ProfileCompatible
+	Algorithms AlgorithmProfile
+
+	// Ciphers, KeyExchanges, MACs and HostKeyAlgorithms override the algorithms
+	// of the profile for their category when not empty
+	Ciphers           []string
+	KeyExchanges      []string
+	MACs              []string
+	HostKeyAlgorithms []string
+
+	// Dialer establishes the connection to the host, as through a SOCKS5Dialer
+	// or HTTPConnectDialer proxy. Defaults to the manager dialer if set or
+	// to a net.Dialer. The dialer is not part of the client identity, configs
+	// differing only by dialer share clients
+	Dialer Dialer
 }
 
 // id returns this Config ID
 func (c ClientConfig) id() (id string) {
 	return strconv.FormatUint(xxhash.Sum64String(
-		fmt.Sprint(c.User, c.NetAddr, c.Port, c.Password, c.Key)), 10)
+		fmt.Sprint(c.User, c.addr(), c.Password, c.Key,
+			c.Algorithms, c.Ciphers, c.KeyExchanges, c.MACs, c.HostKeyAlgorithms)), 10)
+}
+
+// addr returns the host:port address for this Config
+func (c ClientConfig) addr() (addr string) {
+	host, port, err := c.hostPort()
+	if err != nil {
+		return net.JoinHostPort(c.NetAddr, c.Port)
+	}
+	return net.JoinHostPort(host, port)
+}
+
+// Validate checks the config returning a descriptive error for the first invalid field
+func (c ClientConfig) Validate() (err error) {
+	if c, err = c.normalize(); err != nil {
+		return err
+	}
+
+	if len(c.Key) > 0 {
+		if _, err = ssh.ParsePrivateKey(c.Key); err != nil {
+			return fmt.Errorf("invalid client config: unable to parse key: %w", err)
+		}
+	}
+	return nil
+}
+
+// normalize validates the config address and credentials and returns
+// a copy with NetAddr holding only the host and Port set
+func (c ClientConfig) normalize() (config ClientConfig, err error) {
+	host, port, err := c.hostPort()
+	if err != nil {
+		return c, err
+	}
+
+	if c.User == "" {
+		return c, fmt.Errorf("invalid client config: empty username")
+	}
+
+	if c.Password == "" && len(c.Key) == 0 {
+		return c, fmt.Errorf("invalid client config: empty password and key")
+	}
+
+	if _, ok := profiles[c.Algorithms]; c.Algorithms != "" && !ok {
+		return c, fmt.Errorf("invalid client config: unknown algorithm profile %q", c.Algorithms)
+	}
+
+	c.NetAddr, c.Port = host, port
+	return c, nil
+}
+
+// hostPort parses and validates the host and port from NetAddr and Port
+func (c ClientConfig) hostPort() (host, port string, err error) {
+	host, port = c.NetAddr, c.Port
+
+	// NetAddr in the host:port or [ipv6]:port forms, bare IPv6 literals
+	// have too many colons to be split and are used as is
+	if h, p, serr := net.SplitHostPort(c.NetAddr); serr == nil {
+		if p == "" {
+			return "", "", fmt.Errorf("invalid client config: empty port in address %q", c.NetAddr)
+		}
+		if port != "" && port != p {
+			return "", "", fmt.Errorf("invalid client config: port %q conflicts with address %q", port, c.NetAddr)
+		}
+		host, port = h, p
+	} else if strings.HasPrefix(host, "[") && strings.HasSuffix(host, "]") {
+		host = host[1 : len(host)-1]
+	}
+
+	if host == "" {
+		return "", "", fmt.Errorf("invalid client config: empty host address")
+	}
+
+	if strings.ContainsAny(host, "[]/ ") {
+		return "", "", fmt.Errorf("invalid client config: invalid host address %q", c.NetAddr)
+	}
+
+	if port == "" {
+		port = "22"
+	}
+
+	if n, perr := strconv.ParseUint(port, 10, 16); perr != nil || n == 0 {
+		return "", "", fmt.Errorf("invalid client config: port %q is not a number between 1 and 65535", port)
+	}
+
+	return host, port, nil
 }
 
 // newSSHClientConfig creates a ssh.ClientConfig from a ClientConfig
@@ -81,11 +186,8 @@ func newSSHClientConfig(config ClientConfig) (c *ssh.ClientConfig, err error) {
 		c.HostKeyCallback = ssh.InsecureIgnoreHostKey()
 	}
 
-	// Reverse order of available ciphers to prevent early failure in negotiation
-	// with older ssh server versions
-	for i := len(c.Ciphers)/2 - 1; i >= 0; i-- {
-		opp := len(c.Ciphers) - 1 - i
-		c.Ciphers[i], c.Ciphers[opp] = c.Ciphers[opp], c.Ciphers[i]
+	if err = applyAlgorithms(c, config); err != nil {
+		return nil, err
 	}
 
 	return c, nil
@@ -0,0 +1,86 @@
+package sshmgr
+
+import (
+	"net"
+	"reflect"
+	"testing"
+)
+
+func TestConfigHostPort(t *testing.T) {
+	tests := []struct {
+		netAddr string
+		port    string
+		addr    string
+		valid   bool
+	}{
+		{"hosta", "", "hosta:22", true},
+		{"hosta", "2222", "hosta:2222", true},
+		{"hosta:2222", "", "hosta:2222", true},
+		{"hosta:2222", "2222", "hosta:2222", true},
+		{"hosta:2222", "22", "", false},
+		{"10.0.0.1", "", "10.0.0.1:22", true},
+		{"::1", "", "[::1]:22", true},
+		{"fe80::1", "2222", "[fe80::1]:2222", true},
+		{"[::1]", "", "[::1]:22", true},
+		{"[::1]:2222", "", "[::1]:2222", true},
+		{"", "22", "", false},
+		{"hosta", "ssh", "", false},
+		{"hosta", "0", "", false},
+		{"hosta", "65536", "", false},
+		{"[::1]:", "", "", false},
+	}
+
+	for _, test := range tests {
+		config := ClientConfig{NetAddr: test.netAddr, Port: test.port, User: "root", Password: "secret"}
+		normalized, err := config.normalize()
+		if (err == nil) != test.valid {
+			t.Fatalf("%q %q: expected valid %t, got error: %v", test.netAddr, test.port, test.valid, err)
+		}
+
+		if test.valid {
+			if addr := net.JoinHostPort(normalized.NetAddr, normalized.Port); addr != test.addr {
+				t.Fatalf("%q %q: expected address %s, got: %s", test.netAddr, test.port, test.addr, addr)
+			}
+		}
+	}
+}
+
+func TestConfigValidate(t *testing.T) {
+	tests := []ClientConfig{
+		{NetAddr: "hosta", Password: "secret"},
+		{NetAddr: "hosta", User: "root"},
+		{NetAddr: "hosta", User: "root", Key: []byte("not a key")},
+	}
+
+	for _, config := range tests {
+		if err := config.Validate(); err == nil {
+			t.Fatalf("expected validation error for %+v", config)
+		}
+	}
+
+	config := ClientConfig{NetAddr: "hosta:22", User: "root", Password: "secret"}
+	if err := config.Validate(); err != nil {
+		t.Fatal(err)
+	}
+
+	// equivalent address forms share the same client identity
+	other := ClientConfig{NetAddr: "hosta", Port: "22", User: "root", Password: "secret"}
+	if config.id() != other.id() {
+		t.Fatal("expected equivalent configs to have the same id")
+	}
+}
+
+func TestInterleaveFamilies(t *testing.T) {
+	ips := []net.IPAddr{
+		{IP: net.ParseIP("::1")},
+		{IP: net.ParseIP("fe80::1")},
+		{IP: net.ParseIP("10.0.0.1")},
+		{IP: net.ParseIP("10.0.0.2")},
+		{IP: net.ParseIP("10.0.0.3")},
+	}
+
+	expected := []string{"[::1]:22", "10.0.0.1:22", "[fe80::1]:22", "10.0.0.2:22", "10.0.0.3:22"}
+	if addrs := interleaveFamilies(ips, "22"); !reflect.DeepEqual(addrs, expected) {
+		t.Fatalf("expected %v, got: %v", expected, addrs)
+	}
+}
@@ -0,0 +1,423 @@
+package sshmgr
+
+import (
+	"bufio"
+	"context"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+var (
+	errProxyAuth = errors.New("proxy authentication failed")
+)
+
+// Dialer establishes the network connections to ssh servers.
+// It is satisfied by *net.Dialer and by the proxy dialers in this package
+type Dialer interface {
+	DialContext(ctx context.Context, network, addr string) (net.Conn, error)
+}
+
+// dialerFor returns the dialer for config: the config dialer,
+// the manager default dialer or a net.Dialer
+func (m *Manager) dialerFor(config ClientConfig) (dialer Dialer) {
+	switch {
+	case config.Dialer != nil:
+		return config.Dialer
+	case m.dialer != nil:
+		return m.dialer
+	}
+	return &net.Dialer{}
+}
+
+// dial connects to addr with the config dialer bounded by the config DialTimeout.
+// Without a custom dialer all addresses resolved for the host are raced
+func (m *Manager) dial(ctx context.Context, config ClientConfig, addr string) (conn net.Conn, err error) {
+	if config.DialTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, config.DialTimeout)
+		defer cancel()
+	}
+
+	if config.Dialer == nil && m.dialer == nil {
+		return dialHappyEyeballs(ctx, &net.Dialer{}, addr)
+	}
+	return m.dialerFor(config).DialContext(ctx, "tcp", addr)
+}
+
+// fallbackDelay is the delay before starting the next connection attempt
+// while racing resolved addresses, as recommended by RFC 8305
+const fallbackDelay = 250 * time.Millisecond
+
+// dialHappyEyeballs resolves the host in addr and races connection attempts
+// to the resolved addresses, alternating address families and starting the
+// next attempt when the previous fails or after fallbackDelay
+func dialHappyEyeballs(ctx context.Context, d *net.Dialer, addr string) (conn net.Conn, err error) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+
+	if net.ParseIP(host) != nil {
+		return d.DialContext(ctx, "tcp", addr)
+	}
+
+	ips, err := net.DefaultResolver.LookupIPAddr(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+	addrs := interleaveFamilies(ips, port)
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	type result struct {
+		conn net.Conn
+		err  error
+	}
+	results := make(chan result, len(addrs))
+	attempt := func(addr string) {
+		conn, err := d.DialContext(ctx, "tcp", addr)
+		results <- result{conn, err}
+	}
+
+	timer := time.NewTimer(fallbackDelay)
+	defer timer.Stop()
+
+	var errs []error
+	next, pending := 1, 1
+	go attempt(addrs[0])
+
+	for pending > 0 {
+		select {
+		case r := <-results:
+			pending--
+			if r.err == nil {
+				// Close late successful attempts once a winner is chosen
+				go func(n int) {
+					for ; n > 0; n-- {
+						if r := <-results; r.conn != nil {
+							r.conn.Close()
+						}
+					}
+				}(pending)
+				return r.conn, nil
+			}
+			errs = append(errs, r.err)
+
+		case <-timer.C:
+		}
+
+		if next < len(addrs) {
+			go attempt(addrs[next])
+			next++
+			pending++
+			timer.Reset(fallbackDelay)
+		}
+	}
+
+	return nil, errors.Join(errs...)
+}
+
+// interleaveFamilies orders ips alternating IPv6 and IPv4 addresses,
+// starting with the family of the first resolved address
+func interleaveFamilies(ips []net.IPAddr, port string) (addrs []string) {
+	var primary, fallback []string
+	firstIsV4 := ips[0].IP.To4() != nil
+	for _, ip := range ips {
+		if (ip.IP.To4() != nil) == firstIsV4 {
+			primary = append(primary, net.JoinHostPort(ip.String(), port))
+		} else {
+			fallback = append(fallback, net.JoinHostPort(ip.String(), port))
+		}
+	}
+
+	for len(primary) > 0 || len(fallback) > 0 {
+		if len(primary) > 0 {
+			addrs, primary = append(addrs, primary[0]), primary[1:]
+		}
+		if len(fallback) > 0 {
+			addrs, fallback = append(addrs, fallback[0]), fallback[1:]
+		}
+	}
+	return addrs
+}
+
+// SOCKS5Dialer dials through a SOCKS5 proxy using the CONNECT command.
+// Target host names are resolved by the proxy
+type SOCKS5Dialer struct {
+	// Addr is the proxy host:port
+	Addr string
+
+	// Username and Password for proxy authentication, if required
+	Username string
+	Password string
+
+	// Forward dials the proxy, defaults to a net.Dialer
+	Forward Dialer
+}
+
+// DialContext connects to addr through the proxy
+func (d *SOCKS5Dialer) DialContext(ctx context.Context, network, addr string) (conn net.Conn, err error) {
+	host, portStr, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+
+	port, err := strconv.ParseUint(portStr, 10, 16)
+	if err != nil {
+		return nil, fmt.Errorf("socks5: invalid port %q", portStr)
+	}
+
+	if len(host) > 255 {
+		return nil, fmt.Errorf("socks5: host name too long: %s", host)
+	}
+
+	if conn, err = forwardDialer(d.Forward).DialContext(ctx, "tcp", d.Addr); err != nil {
+		return nil, err
+	}
+
+	if err = withContext(ctx, conn, func() error { return d.connect(conn, host, uint16(port)) }); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return conn, nil
+}
+
+// connect performs the SOCKS5 negotiation and CONNECT request on conn
+func (d *SOCKS5Dialer) connect(conn net.Conn, host string, port uint16) (err error) {
+	methods := []byte{socks5NoAuth}
+	if d.Username != "" {
+		methods = append(methods, socks5UserPassAuth)
+	}
+
+	if _, err = conn.Write(append([]byte{socks5Version, byte(len(methods))}, methods...)); err != nil {
+		return err
+	}
+
+	reply := make([]byte, 2)
+	if _, err = io.ReadFull(conn, reply); err != nil {
+		return err
+	}
+
+	if reply[0] != socks5Version {
+		return fmt.Errorf("socks5: unexpected protocol version %d", reply[0])
+	}
+
+	switch reply[1] {
+	case socks5NoAuth:
+	case socks5UserPassAuth:
+		if err = d.authenticate(conn); err != nil {
+			return err
+		}
+	case socks5NoAcceptable:
+		return errors.New("socks5: no acceptable authentication methods")
+	default:
+		return fmt.Errorf("socks5: unexpected authentication method %d", reply[1])
+	}
+
+	req := []byte{socks5Version, socks5Connect, 0}
+	if ip := net.ParseIP(host); ip != nil {
+		if ip4 := ip.To4(); ip4 != nil {
+			req = append(append(req, socks5AddrIPv4), ip4...)
+		} else {
+			req = append(append(req, socks5AddrIPv6), ip...)
+		}
+	} else {
+		req = append(append(req, socks5AddrDomain, byte(len(host))), host...)
+	}
+	req = binary.BigEndian.AppendUint16(req, port)
+
+	if _, err = conn.Write(req); err != nil {
+		return err
+	}
+
+	if _, err = readSOCKS5Reply(conn); err != nil {
+		return err
+	}
+	return nil
+}
+
+// authenticate performs the username/password authentication from RFC 1929
+func (d *SOCKS5Dialer) authenticate(conn net.Conn) (err error) {
+	if len(d.Username) > 255 || len(d.Password) > 255 {
+		return errors.New("socks5: username or password too long")
+	}
+
+	req := []byte{socks5AuthVersion, byte(len(d.Username))}
+	req = append(req, d.Username...)
+	req = append(req, byte(len(d.Password)))
+	req = append(req, d.Password...)
+
+	if _, err = conn.Write(req); err != nil {
+		return err
+	}
+
+	reply := make([]byte, 2)
+	if _, err = io.ReadFull(conn, reply); err != nil {
+		return err
+	}
+
+	if reply[1] != 0 {
+		return errProxyAuth
+	}
+	return nil
+}
+
+// readSOCKS5Reply reads a CONNECT reply returning the bound address
+func readSOCKS5Reply(r io.Reader) (bound string, err error) {
+	header := make([]byte, 4)
+	if _, err = io.ReadFull(r, header); err != nil {
+		return "", err
+	}
+
+	if header[1] != 0 {
+		return "", fmt.Errorf("socks5: connect failed: %s", socks5ReplyText(header[1]))
+	}
+
+	var host []byte
+	switch header[3] {
+	case socks5AddrIPv4:
+		host = make([]byte, net.IPv4len)
+	case socks5AddrIPv6:
+		host = make([]byte, net.IPv6len)
+	case socks5AddrDomain:
+		size := make([]byte, 1)
+		if _, err = io.ReadFull(r, size); err != nil {
+			return "", err
+		}
+		host = make([]byte, size[0])
+	default:
+		return "", fmt.Errorf("socks5: unknown address type %d", header[3])
+	}
+
+	port := make([]byte, 2)
+	if _, err = io.ReadFull(r, host); err != nil {
+		return "", err
+	}
+	if _, err = io.ReadFull(r, port); err != nil {
+		return "", err
+	}
+
+	if header[3] != socks5AddrDomain {
+		host = []byte(net.IP(host).String())
+	}
+	return net.JoinHostPort(string(host), strconv.Itoa(int(binary.BigEndian.Uint16(port)))), nil
+}
+
+// HTTPConnectDialer dials through a HTTP proxy using the CONNECT method
+type HTTPConnectDialer struct {
+	// Addr is the proxy host:port
+	Addr string
+
+	// Username and Password for proxy basic authentication, if required
+	Username string
+	Password string
+
+	// Header holds additional headers sent with the CONNECT request
+	Header http.Header
+
+	// Forward dials the proxy, defaults to a net.Dialer
+	Forward Dialer
+}
+
+// DialContext connects to addr through the proxy
+func (d *HTTPConnectDialer) DialContext(ctx context.Context, network, addr string) (conn net.Conn, err error) {
+	if conn, err = forwardDialer(d.Forward).DialContext(ctx, "tcp", d.Addr); err != nil {
+		return nil, err
+	}
+
+	var br *bufio.Reader
+	err = withContext(ctx, conn, func() (err error) {
+		br, err = d.connect(conn, addr)
+		return err
+	})
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	// The proxy may have sent data past the response headers
+	if br.Buffered() > 0 {
+		return &bufferedConn{Conn: conn, r: br}, nil
+	}
+	return conn, nil
+}
+
+// connect sends the CONNECT request and reads the proxy response
+func (d *HTTPConnectDialer) connect(conn net.Conn, addr string) (br *bufio.Reader, err error) {
+	req := &http.Request{
+		Method: http.MethodConnect,
+		URL:    &url.URL{Opaque: addr},
+		Host:   addr,
+		Header: http.Header{},
+	}
+
+	for name, values := range d.Header {
+		req.Header[name] = values
+	}
+
+	if d.Username != "" {
+		credentials := base64.StdEncoding.EncodeToString([]byte(d.Username + ":" + d.Password))
+		req.Header.Set("Proxy-Authorization", "Basic "+credentials)
+	}
+
+	if err = req.Write(conn); err != nil {
+		return nil, err
+	}
+
+	br = bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, req)
+	if err != nil {
+		return nil, err
+	}
+	resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+		return br, nil
+	case http.StatusProxyAuthRequired:
+		return nil, errProxyAuth
+	}
+	return nil, fmt.Errorf("http connect: proxy returned %s", resp.Status)
+}
+
+// bufferedConn is a net.Conn reading first from a buffered reader
+type bufferedConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func (c *bufferedConn) Read(p []byte) (n int, err error) {
+	return c.r.Read(p)
+}
+
+// forwardDialer returns d or a net.Dialer if d is nil
+func forwardDialer(d Dialer) (dialer Dialer) {
+	if d == nil {
+		return &net.Dialer{}
+	}
+	return d
+}
+
+// withContext runs fn on conn bounded by the ctx deadline and cancellation
+func withContext(ctx context.Context, conn net.Conn, fn func() error) (err error) {
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+		defer conn.SetDeadline(time.Time{})
+	}
+
+	stop := context.AfterFunc(ctx, func() { conn.SetDeadline(time.Unix(1, 0)) })
+	err = fn()
+	if !stop() {
+		return ctx.Err()
+	}
+	return err
+}
@@ -0,0 +1,182 @@
+package sshmgr
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"testing"
+)
+
+// echoServer accepts connections echoing back everything received
+func echoServer(t *testing.T) (addr string) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				io.Copy(conn, conn)
+				conn.Close()
+			}()
+		}
+	}()
+	return l.Addr().String()
+}
+
+// proxyServer accepts connections on a local listener handling them with handle
+func proxyServer(t *testing.T, handle func(conn net.Conn)) (addr string) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go handle(conn)
+		}
+	}()
+	return l.Addr().String()
+}
+
+func pipe(a, b net.Conn) {
+	go io.Copy(a, b)
+	io.Copy(b, a)
+	a.Close()
+	b.Close()
+}
+
+func assertEcho(t *testing.T, conn net.Conn) {
+	defer conn.Close()
+	if _, err := conn.Write([]byte("ping")); err != nil {
+		t.Fatal(err)
+	}
+
+	buf := make([]byte, 4)
+	if _, err := io.ReadFull(conn, buf); err != nil {
+		t.Fatal(err)
+	}
+
+	if string(buf) != "ping" {
+		t.Fatalf("expected ping, got: %s", buf)
+	}
+}
+
+func TestSOCKS5Dialer(t *testing.T) {
+	target := echoServer(t)
+
+	proxy := proxyServer(t, func(conn net.Conn) {
+		buf := make([]byte, 512)
+		// methods, expect username/password
+		io.ReadFull(conn, buf[:2])
+		io.ReadFull(conn, buf[:buf[1]])
+		conn.Write([]byte{socks5Version, socks5UserPassAuth})
+
+		io.ReadFull(conn, buf[:2])
+		user := make([]byte, buf[1])
+		io.ReadFull(conn, user)
+		io.ReadFull(conn, buf[:1])
+		pass := make([]byte, buf[0])
+		io.ReadFull(conn, pass)
+		if string(user) != "user" || string(pass) != "pass" {
+			conn.Write([]byte{socks5AuthVersion, 1})
+			conn.Close()
+			return
+		}
+		conn.Write([]byte{socks5AuthVersion, 0})
+
+		// connect request with a domain address
+		io.ReadFull(conn, buf[:4])
+		io.ReadFull(conn, buf[:1])
+		host := make([]byte, buf[0])
+		io.ReadFull(conn, host)
+		io.ReadFull(conn, buf[:2])
+		port := binary.BigEndian.Uint16(buf[:2])
+
+		if string(host) != "localhost" {
+			conn.Write([]byte{socks5Version, 0x04, 0, socks5AddrIPv4, 0, 0, 0, 0, 0, 0})
+			conn.Close()
+			return
+		}
+
+		out, err := net.Dial("tcp", net.JoinHostPort("127.0.0.1", strconv.Itoa(int(port))))
+		if err != nil {
+			conn.Close()
+			return
+		}
+		conn.Write([]byte{socks5Version, 0, 0, socks5AddrIPv4, 127, 0, 0, 1, 0, 0})
+		pipe(conn, out)
+	})
+
+	_, port, _ := net.SplitHostPort(target)
+	d := &SOCKS5Dialer{Addr: proxy, Username: "user", Password: "pass"}
+	conn, err := d.DialContext(context.Background(), "tcp", net.JoinHostPort("localhost", port))
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertEcho(t, conn)
+
+	d.Password = "wrong"
+	if _, err = d.DialContext(context.Background(), "tcp", net.JoinHostPort("localhost", port)); err != errProxyAuth {
+		t.Fatalf("expected authentication error, got: %v", err)
+	}
+}
+
+func TestHTTPConnectDialer(t *testing.T) {
+	target := echoServer(t)
+
+	proxy := proxyServer(t, func(conn net.Conn) {
+		req, err := http.ReadRequest(bufio.NewReader(conn))
+		if err != nil {
+			conn.Close()
+			return
+		}
+
+		if user, pass, ok := parseProxyAuth(req); !ok || user != "user" || pass != "pass" {
+			conn.Write([]byte("HTTP/1.1 407 Proxy Authentication Required\r\n\r\n"))
+			conn.Close()
+			return
+		}
+
+		out, err := net.Dial("tcp", req.Host)
+		if err != nil {
+			conn.Write([]byte("HTTP/1.1 502 Bad Gateway\r\n\r\n"))
+			conn.Close()
+			return
+		}
+		conn.Write([]byte("HTTP/1.1 200 Connection established\r\n\r\n"))
+		pipe(conn, out)
+	})
+
+	d := &HTTPConnectDialer{Addr: proxy, Username: "user", Password: "pass"}
+	conn, err := d.DialContext(context.Background(), "tcp", target)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertEcho(t, conn)
+
+	d.Password = "wrong"
+	if _, err = d.DialContext(context.Background(), "tcp", target); err != errProxyAuth {
+		t.Fatalf("expected authentication error, got: %v", err)
+	}
+}
+
+func parseProxyAuth(req *http.Request) (user, pass string, ok bool) {
+	r := &http.Request{Header: http.Header{"Authorization": req.Header["Proxy-Authorization"]}}
+	return r.BasicAuth()
+}
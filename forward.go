@@ -0,0 +1,512 @@
+package sshmgr
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log/slog"
+	"net"
+	"sync"
+	"sync/atomic"
+)
+
+// TunnelStats holds the connection and byte counters of a tunnel
+type TunnelStats struct {
+	// Connections is the total number of forwarded connections
+	Connections int64
+	// Active is the number of connections currently forwarded
+	Active int64
+	// Sent is the number of bytes sent from local to remote peers
+	Sent int64
+	// Received is the number of bytes received from remote peers
+	Received int64
+}
+
+// tunnel tracks the forwarded connections of a listener,
+// calling release once closed
+type tunnel struct {
+	mgr       *Manager
+	release   func() error
+	listener  net.Listener
+	log       *slog.Logger
+	mtx       sync.Mutex
+	conns     map[net.Conn]struct{}
+	wg        sync.WaitGroup
+	closeOnce sync.Once
+	err       error
+	total     int64
+	active    int64
+	sent      int64
+	received  int64
+}
+
+func newTunnel(c *Client, listener net.Listener, log *slog.Logger, release func() error) (t *tunnel) {
+	atomic.AddInt64(&c.mgr.tunnels, 1)
+	return &tunnel{
+		mgr:      c.mgr,
+		release:  release,
+		listener: listener,
+		log:      log,
+		conns:    map[net.Conn]struct{}{},
+	}
+}
+
+// serve accepts connections on the listener forwarding them
+// to the connection returned by dial until the listener is closed
+func (t *tunnel) serve(dial func(conn net.Conn) (net.Conn, error)) {
+	defer t.wg.Done()
+
+	for {
+		conn, err := t.listener.Accept()
+		if err != nil {
+			if !errors.Is(err, net.ErrClosed) && !errors.Is(err, io.EOF) {
+				t.log.Error("tunnel accept failed", slog.Any("error", err))
+			}
+			return
+		}
+
+		if !t.track(conn) {
+			conn.Close()
+			return
+		}
+
+		t.wg.Add(1)
+		go func() {
+			defer t.wg.Done()
+			defer t.untrack(conn)
+
+			remote, err := dial(conn)
+			if err != nil {
+				t.log.Warn("tunnel dial failed", slog.Any("error", err))
+				return
+			}
+
+			if !t.track(remote) {
+				remote.Close()
+				return
+			}
+			defer t.untrack(remote)
+
+			atomic.AddInt64(&t.total, 1)
+			atomic.AddInt64(&t.active, 1)
+			defer atomic.AddInt64(&t.active, -1)
+			proxy(conn, remote, &t.sent, &t.received)
+		}()
+	}
+}
+
+// track registers conn to be closed with the tunnel,
+// returning false if the tunnel is already closed
+func (t *tunnel) track(conn net.Conn) (ok bool) {
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+
+	if t.conns == nil {
+		return false
+	}
+	t.conns[conn] = struct{}{}
+	return true
+}
+
+func (t *tunnel) untrack(conn net.Conn) {
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+
+	conn.Close()
+	delete(t.conns, conn)
+}
+
+// close stops accepting, closes all forwarded connections
+// and releases the tunnel resources
+func (t *tunnel) close() (err error) {
+	t.closeOnce.Do(func() {
+		t.err = t.listener.Close()
+
+		t.mtx.Lock()
+		for conn := range t.conns {
+			conn.Close()
+		}
+		t.conns = nil
+		t.mtx.Unlock()
+
+		t.wg.Wait()
+		if t.release != nil {
+			t.release()
+		}
+		atomic.AddInt64(&t.mgr.tunnels, -1)
+		t.log.Info("tunnel closed")
+	})
+	return t.err
+}
+
+func (t *tunnel) stats() (stats TunnelStats) {
+	return TunnelStats{
+		Connections: atomic.LoadInt64(&t.total),
+		Active:      atomic.LoadInt64(&t.active),
+		Sent:        atomic.LoadInt64(&t.sent),
+		Received:    atomic.LoadInt64(&t.received),
+	}
+}
+
+// proxy copies data between local and remote until both directions are done,
+// counting the bytes sent to and received from remote
+func proxy(local, remote net.Conn, sent, received *int64) {
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		copyCounted(remote, local, sent)
+	}()
+	copyCounted(local, remote, received)
+	wg.Wait()
+}
+
+// copyCounted copies src to dst adding the copied bytes to n,
+// and closes the write side of dst once src is exhausted
+func copyCounted(dst, src net.Conn, n *int64) {
+	buf := make([]byte, 32<<10)
+	for {
+		nr, err := src.Read(buf)
+		if nr > 0 {
+			nw, werr := dst.Write(buf[:nr])
+			atomic.AddInt64(n, int64(nw))
+			if werr != nil {
+				break
+			}
+		}
+		if err != nil {
+			break
+		}
+	}
+
+	if cw, ok := dst.(interface{ CloseWrite() error }); ok {
+		cw.CloseWrite()
+		return
+	}
+	dst.Close()
+}
+
+// dialRemote connects to addr from the remote host through the client,
+// retried on a dead transport in the resilient client mode
+func (c *Client) dialRemote(ctx context.Context, network, addr string) (conn net.Conn, err error) {
+	type result struct {
+		conn net.Conn
+		err  error
+	}
+
+	err = c.retry(ctx, "dial", func() (err error) {
+		client, _ := c.transport()
+		if ctx.Done() == nil {
+			conn, err = client.Dial(network, addr)
+			return err
+		}
+
+		// Channel opens can't be cancelled, close late connections instead
+		results := make(chan result, 1)
+		go func() {
+			conn, err := client.Dial(network, addr)
+			results <- result{conn, err}
+		}()
+
+		select {
+		case r := <-results:
+			conn = r.conn
+			return r.err
+		case <-ctx.Done():
+			go func() {
+				if r := <-results; r.conn != nil {
+					r.conn.Close()
+				}
+			}()
+			return ctx.Err()
+		}
+	})
+	return conn, err
+}
+
+// LocalTunnel forwards connections accepted on a local address
+// to a remote address through a managed client, like ssh -L
+type LocalTunnel struct {
+	*tunnel
+	raddr string
+}
+
+// LocalForward listens on the local laddr and forwards each accepted connection
+// to raddr through the client. The tunnel holds a reference on the client
+// until it is closed
+func (c *Client) LocalForward(laddr, raddr string) (tunnel *LocalTunnel, err error) {
+	if c.isClosed() {
+		return nil, errClientClosed
+	}
+
+	listener, err := net.Listen("tcp", laddr)
+	if err != nil {
+		return nil, err
+	}
+
+	c.incr()
+	return c.localForward(listener, raddr), nil
+}
+
+// localForward starts forwarding connections from listener to raddr,
+// taking over a client reference already held by the caller
+func (c *Client) localForward(listener net.Listener, raddr string) (tunnel *LocalTunnel) {
+	log := c.log.With(slog.String("local", listener.Addr().String()), slog.String("remote", raddr))
+	tunnel = &LocalTunnel{tunnel: newTunnel(c, listener, log, c.Close), raddr: raddr}
+
+	tunnel.wg.Add(1)
+	go tunnel.serve(func(conn net.Conn) (remote net.Conn, err error) {
+		return c.dialRemote(context.Background(), "tcp", raddr)
+	})
+
+	log.Info("local forward started")
+	return tunnel
+}
+
+// LocalForward listens on the local laddr and forwards each accepted connection
+// to raddr through a managed client for config
+func (m *Manager) LocalForward(config ClientConfig, laddr, raddr string) (tunnel *LocalTunnel, err error) {
+	listener, err := net.Listen("tcp", laddr)
+	if err != nil {
+		return nil, err
+	}
+
+	client, err := m.SSHClient(config)
+	if err != nil {
+		listener.Close()
+		return nil, err
+	}
+	return client.localForward(listener, raddr), nil
+}
+
+// Addr returns the local listening address
+func (t *LocalTunnel) Addr() (addr net.Addr) {
+	return t.listener.Addr()
+}
+
+// RemoteAddr returns the address connections are forwarded to
+func (t *LocalTunnel) RemoteAddr() (addr string) {
+	return t.raddr
+}
+
+// Stats returns the tunnel connection and byte counters
+func (t *LocalTunnel) Stats() (stats TunnelStats) {
+	return t.stats()
+}
+
+// Close stops the tunnel, closing all forwarded connections
+// and releasing the client reference
+func (t *LocalTunnel) Close() (err error) {
+	return t.close()
+}
+
+// RemoteListener is a net.Listener on a remote address of a managed client
+// using the tcpip-forward request, like ssh -R. It holds a reference on the
+// client until closed. In the resilient client mode the listener is
+// reestablished when the transport is reconnected, on a new port if
+// the remote address port was 0
+type RemoteListener struct {
+	client *Client
+	raddr  string
+	mtx    sync.Mutex
+	ln     net.Listener
+	closed bool
+	err    error
+}
+
+// RemoteListen listens on raddr on the remote host
+func (c *Client) RemoteListen(raddr string) (listener *RemoteListener, err error) {
+	if c.isClosed() {
+		return nil, errClientClosed
+	}
+
+	c.incr()
+	if listener, err = c.remoteListen(raddr); err != nil {
+		c.Close()
+		return nil, err
+	}
+	return listener, nil
+}
+
+// remoteListen listens on raddr on the remote host,
+// taking over a client reference already held by the caller
+func (c *Client) remoteListen(raddr string) (listener *RemoteListener, err error) {
+	listener = &RemoteListener{client: c, raddr: raddr}
+	err = c.retry(context.Background(), "forward.listen", func() error {
+		return listener.listen(nil)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	c.log.Info("remote listener started", slog.String("remote", listener.Addr().String()))
+	return listener, nil
+}
+
+// RemoteListen listens on raddr on the remote host of a managed client for config
+func (m *Manager) RemoteListen(config ClientConfig, raddr string) (listener *RemoteListener, err error) {
+	client, err := m.SSHClient(config)
+	if err != nil {
+		return nil, err
+	}
+
+	if listener, err = client.remoteListen(raddr); err != nil {
+		client.Close()
+		return nil, err
+	}
+	return listener, nil
+}
+
+// listen replaces the failed listener old with a new listener on the current
+// transport, unless it was already replaced by a concurrent Accept
+func (l *RemoteListener) listen(old net.Listener) (err error) {
+	l.mtx.Lock()
+	defer l.mtx.Unlock()
+
+	if l.closed {
+		return net.ErrClosed
+	}
+
+	if l.ln != old {
+		return nil
+	}
+
+	client, _ := l.client.transport()
+	ln, err := client.Listen("tcp", l.raddr)
+	if err != nil {
+		return err
+	}
+
+	if old != nil {
+		old.Close()
+	}
+	l.ln = ln
+	return nil
+}
+
+// current returns the current listener or nil if closed
+func (l *RemoteListener) current() (ln net.Listener) {
+	l.mtx.Lock()
+	defer l.mtx.Unlock()
+
+	if l.closed {
+		return nil
+	}
+	return l.ln
+}
+
+// Accept waits for and returns the next connection to the listener
+func (l *RemoteListener) Accept() (conn net.Conn, err error) {
+	for {
+		ln := l.current()
+		if ln == nil {
+			return nil, net.ErrClosed
+		}
+
+		if conn, err = ln.Accept(); err == nil {
+			return conn, nil
+		}
+
+		if l.current() == nil {
+			return nil, net.ErrClosed
+		}
+
+		if l.client.mgr.retry.MaxAttempts <= 1 {
+			return nil, err
+		}
+
+		l.client.log.Warn("remote listener failed, listening again", slog.Any("error", err))
+		err = l.client.retry(context.Background(), "forward.listen", func() error {
+			return l.listen(ln)
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+}
+
+// Close stops listening on the remote host and releases the client reference
+func (l *RemoteListener) Close() (err error) {
+	l.mtx.Lock()
+	if l.closed {
+		l.mtx.Unlock()
+		return l.err
+	}
+	l.closed = true
+	l.err = l.ln.Close()
+	l.mtx.Unlock()
+
+	l.client.Close()
+	return l.err
+}
+
+// Addr returns the listener address on the remote host
+func (l *RemoteListener) Addr() (addr net.Addr) {
+	l.mtx.Lock()
+	defer l.mtx.Unlock()
+	return l.ln.Addr()
+}
+
+// RemoteTunnel forwards connections accepted on a remote address
+// to a local address through a managed client, like ssh -R
+type RemoteTunnel struct {
+	*tunnel
+	listener *RemoteListener
+	laddr    string
+}
+
+// RemoteForward listens on raddr on the remote host and forwards each accepted
+// connection to the local laddr. The tunnel holds a reference on the client
+// until it is closed
+func (c *Client) RemoteForward(raddr, laddr string) (tunnel *RemoteTunnel, err error) {
+	listener, err := c.RemoteListen(raddr)
+	if err != nil {
+		return nil, err
+	}
+	return c.remoteForward(listener, laddr), nil
+}
+
+func (c *Client) remoteForward(listener *RemoteListener, laddr string) (tunnel *RemoteTunnel) {
+	log := c.log.With(slog.String("remote", listener.Addr().String()), slog.String("local", laddr))
+	tunnel = &RemoteTunnel{tunnel: newTunnel(c, listener, log, nil), listener: listener, laddr: laddr}
+
+	dialer := &net.Dialer{}
+	tunnel.wg.Add(1)
+	go tunnel.serve(func(conn net.Conn) (local net.Conn, err error) {
+		return dialer.Dial("tcp", laddr)
+	})
+
+	log.Info("remote forward started")
+	return tunnel
+}
+
+// RemoteForward listens on raddr on the remote host of a managed client for config
+// and forwards each accepted connection to the local laddr
+func (m *Manager) RemoteForward(config ClientConfig, raddr, laddr string) (tunnel *RemoteTunnel, err error) {
+	listener, err := m.RemoteListen(config, raddr)
+	if err != nil {
+		return nil, err
+	}
+	return listener.client.remoteForward(listener, laddr), nil
+}
+
+// Addr returns the listening address on the remote host
+func (t *RemoteTunnel) Addr() (addr net.Addr) {
+	return t.listener.Addr()
+}
+
+// LocalAddr returns the address connections are forwarded to
+func (t *RemoteTunnel) LocalAddr() (addr string) {
+	return t.laddr
+}
+
+// Stats returns the tunnel connection and byte counters
+func (t *RemoteTunnel) Stats() (stats TunnelStats) {
+	return t.stats()
+}
+
+// Close stops the tunnel, closing all forwarded connections
+// and releasing the client reference
+func (t *RemoteTunnel) Close() (err error) {
+	return t.close()
+}
@@ -0,0 +1,133 @@
+package sshmgr
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestLocalForward(t *testing.T) {
+	server := newTestServer(t)
+	target := echoServer(t)
+
+	manager := New(time.Minute, time.Minute)
+	defer manager.Close()
+
+	tunnel, err := manager.LocalForward(server.clientConfig(), "127.0.0.1:0", target)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 2; i++ {
+		conn, err := net.Dial("tcp", tunnel.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		assertEcho(t, conn)
+	}
+
+	if stats := manager.Stats(); stats.InUse != 1 {
+		t.Fatalf("expected the tunnel to hold the client, got %d in use", stats.InUse)
+	}
+
+	if err = tunnel.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	stats := tunnel.Stats()
+	if stats.Connections != 2 || stats.Active != 0 || stats.Sent != 8 || stats.Received != 8 {
+		t.Fatalf("unexpected tunnel stats: %+v", stats)
+	}
+
+	if stats := manager.Stats(); stats.InUse != 0 {
+		t.Fatalf("expected the client to be released, got %d in use", stats.InUse)
+	}
+}
+
+func TestRemoteForward(t *testing.T) {
+	server := newTestServer(t)
+	target := echoServer(t)
+
+	manager := New(time.Minute, time.Minute)
+	defer manager.Close()
+
+	tunnel, err := manager.RemoteForward(server.clientConfig(), "127.0.0.1:0", target)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	conn, err := net.Dial("tcp", tunnel.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertEcho(t, conn)
+
+	if stats := manager.Stats(); stats.InUse != 1 {
+		t.Fatalf("expected the listener to hold the client, got %d in use", stats.InUse)
+	}
+
+	if err = tunnel.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if stats := tunnel.Stats(); stats.Connections != 1 || stats.Sent != 4 || stats.Received != 4 {
+		t.Fatalf("unexpected tunnel stats: %+v", stats)
+	}
+
+	if stats := manager.Stats(); stats.InUse != 0 {
+		t.Fatalf("expected the client to be released, got %d in use", stats.InUse)
+	}
+
+	if _, err = net.Dial("tcp", tunnel.Addr().String()); err == nil {
+		t.Fatal("expected the remote listener to be closed")
+	}
+}
+
+func TestDynamicForward(t *testing.T) {
+	server := newTestServer(t)
+	target := echoServer(t)
+
+	manager := New(time.Minute, time.Minute)
+	defer manager.Close()
+
+	auth := func(username, password string) bool { return username == "user" && password == "pass" }
+	proxy, err := manager.DynamicForward(server.clientConfig(), "127.0.0.1:0", auth)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if stats := manager.Stats(); stats.InUse != 1 || stats.Tunnels != 1 {
+		t.Fatalf("expected the proxy to hold the client, got: %+v", stats)
+	}
+
+	_, port, _ := net.SplitHostPort(target)
+	d := &SOCKS5Dialer{Addr: proxy.Addr().String(), Username: "user", Password: "pass"}
+	conn, err := d.DialContext(context.Background(), "tcp", net.JoinHostPort("localhost", port))
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertEcho(t, conn)
+
+	d.Password = "wrong"
+	if _, err = d.DialContext(context.Background(), "tcp", target); err != errProxyAuth {
+		t.Fatalf("expected authentication error, got: %v", err)
+	}
+
+	d.Password = "pass"
+	if _, err = d.DialContext(context.Background(), "tcp", "127.0.0.1:1"); err == nil {
+		t.Fatal("expected connect failure")
+	}
+
+	if err = proxy.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if stats := proxy.Stats(); stats.Connections != 1 || stats.Sent != 4 || stats.Received != 4 {
+		t.Fatalf("unexpected proxy stats: %+v", stats)
+	}
+
+	if stats := manager.Stats(); stats.InUse != 0 || stats.Tunnels != 0 {
+		t.Fatalf("expected the client to be released, got: %+v", stats)
+	}
+}
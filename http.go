@@ -0,0 +1,108 @@
+package sshmgr
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"sync"
+)
+
+// DialContext connects to addr from the remote host through the client.
+// Supported networks are tcp, tcp4, tcp6 and unix, using streamlocal
+// forwarding for unix sockets. Client satisfies Dialer, so it can be used
+// as the dialer of connections to hosts only reachable from the remote host
+func (c *Client) DialContext(ctx context.Context, network, addr string) (conn net.Conn, err error) {
+	if c.isClosed() {
+		return nil, errClientClosed
+	}
+	return c.dialRemote(ctx, network, addr)
+}
+
+// HTTPTransport returns a http.Transport making connections through the client,
+// with the http.DefaultTransport settings and no proxy
+func (c *Client) HTTPTransport() (transport *http.Transport) {
+	return httpTransport(c.DialContext)
+}
+
+// UnixHTTPTransport returns a http.Transport making all connections
+// to the unix socket at path on the remote host through the client
+func (c *Client) UnixHTTPTransport(path string) (transport *http.Transport) {
+	return httpTransport(unixDialer(c.DialContext, path))
+}
+
+// Dialer returns a Dialer connecting from the remote host of a managed client
+// for config. Each connection holds a reference on the client until closed
+func (m *Manager) Dialer(config ClientConfig) (dialer Dialer) {
+	return &managedDialer{mgr: m, config: config}
+}
+
+// HTTPTransport returns a http.Transport making connections through a managed
+// client for config, with the http.DefaultTransport settings and no proxy.
+// Idle connections hold client references until closed with CloseIdleConnections
+// or the transport IdleConnTimeout
+func (m *Manager) HTTPTransport(config ClientConfig) (transport *http.Transport) {
+	return httpTransport(m.Dialer(config).DialContext)
+}
+
+// UnixHTTPTransport returns a http.Transport making all connections to the unix
+// socket at path on the remote host of a managed client for config
+func (m *Manager) UnixHTTPTransport(config ClientConfig, path string) (transport *http.Transport) {
+	return httpTransport(unixDialer(m.Dialer(config).DialContext, path))
+}
+
+type dialFunc func(ctx context.Context, network, addr string) (net.Conn, error)
+
+func httpTransport(dial dialFunc) (transport *http.Transport) {
+	transport = http.DefaultTransport.(*http.Transport).Clone()
+	transport.Proxy = nil
+	transport.DialContext = dial
+	return transport
+}
+
+// unixDialer returns a dialFunc ignoring the requested address
+// and connecting to the unix socket at path
+func unixDialer(dial dialFunc, path string) (unix dialFunc) {
+	return func(ctx context.Context, _, _ string) (net.Conn, error) {
+		return dial(ctx, "unix", path)
+	}
+}
+
+// managedDialer dials through a managed client for config
+type managedDialer struct {
+	mgr    *Manager
+	config ClientConfig
+}
+
+func (d *managedDialer) DialContext(ctx context.Context, network, addr string) (conn net.Conn, err error) {
+	client, err := d.mgr.SSHClientContext(ctx, d.config)
+	if err != nil {
+		return nil, err
+	}
+
+	if conn, err = client.dialRemote(ctx, network, addr); err != nil {
+		client.Close()
+		return nil, err
+	}
+	return &refConn{Conn: conn, client: client}, nil
+}
+
+// refConn releases a client reference when closed
+type refConn struct {
+	net.Conn
+	client *Client
+	once   sync.Once
+}
+
+func (c *refConn) Close() (err error) {
+	err = c.Conn.Close()
+	c.once.Do(func() { c.client.Close() })
+	return err
+}
+
+// CloseWrite closes the write side of the connection if supported
+func (c *refConn) CloseWrite() (err error) {
+	if cw, ok := c.Conn.(interface{ CloseWrite() error }); ok {
+		return cw.CloseWrite()
+	}
+	return c.Close()
+}
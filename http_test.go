@@ -0,0 +1,66 @@
+package sshmgr
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestHTTPTransport(t *testing.T) {
+	server := newTestServer(t)
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "hello from "+r.URL.Path)
+	})
+
+	web := httptest.NewServer(handler)
+	defer web.Close()
+
+	socket := filepath.Join(t.TempDir(), "api.sock")
+	l, err := net.Listen("unix", socket)
+	if err != nil {
+		t.Fatal(err)
+	}
+	unix := &http.Server{Handler: handler}
+	go unix.Serve(l)
+	defer unix.Close()
+
+	manager := New(time.Minute, time.Minute)
+	defer manager.Close()
+
+	get := func(transport *http.Transport, url, expected string) {
+		defer transport.CloseIdleConnections()
+
+		resp, err := (&http.Client{Transport: transport}).Get(url)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+
+		body, err := io.ReadAll(resp.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if string(body) != expected {
+			t.Fatalf("expected %q, got: %q", expected, body)
+		}
+	}
+
+	get(manager.HTTPTransport(server.clientConfig()), web.URL+"/tcp", "hello from /tcp")
+	get(manager.UnixHTTPTransport(server.clientConfig(), socket), "http://docker/unix", "hello from /unix")
+
+	if stats := manager.Stats(); stats.InUse != 0 {
+		t.Fatalf("expected connections to release the client, got %d in use", stats.InUse)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err = manager.Dialer(server.clientConfig()).DialContext(ctx, "tcp", web.Listener.Addr().String()); err == nil {
+		t.Fatal("expected dial with a cancelled context to fail")
+	}
+}
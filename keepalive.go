@@ -0,0 +1,156 @@
+package sshmgr
+
+import (
+	"errors"
+	"log/slog"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+var (
+	errProbeTimeout = errors.New("liveness probe timed out")
+)
+
+// keepaliveRequest is the global request used for probes and keepalives,
+// servers reply to it even if it is not supported
+const keepaliveRequest = "keepalive@openssh.com"
+
+// defaultProbeTimeout bounds probes used to detect dead transports
+// when no ProbeTimeout is configured
+const defaultProbeTimeout = 10 * time.Second
+
+// HealthCheck configures client liveness checking
+type HealthCheck struct {
+	// Interval between keepalives sent on every client, like ServerAliveInterval.
+	// Keepalives are disabled if zero
+	Interval time.Duration
+
+	// CountMax is the number of consecutive keepalives without reply after which
+	// the client is considered dead and removed, like ServerAliveCountMax.
+	// Defaults to 3
+	CountMax int
+
+	// ProbeTimeout bounds the wait for a keepalive or on acquire probe reply,
+	// transports not replying to a probe in time are closed. Keepalives wait
+	// for Interval and probes for 10 seconds if zero
+	ProbeTimeout time.Duration
+
+	// SkipProbeWithin skips the probe when acquiring a client if a keepalive
+	// or probe succeeded within this duration. Clients are always probed if zero
+	SkipProbeWithin time.Duration
+}
+
+// probe sends a keepalive request and waits for the reply up to timeout.
+// A transport not replying within timeout is considered dead and discarded,
+// which also unblocks the pending request
+func (c *Client) probe(timeout time.Duration) (err error) {
+	client, done := c.transport()
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	select {
+	case err = <-sendKeepalive(client):
+		if err == nil {
+			c.markAlive()
+		}
+		return err
+	case <-timer.C:
+		c.log.Warn("liveness probe timed out, closing transport", slog.Duration("timeout", timeout))
+		c.discard(done)
+		return errProbeTimeout
+	}
+}
+
+// sendKeepalive sends a keepalive request returning a channel receiving its result
+func sendKeepalive(client *ssh.Client) (result chan error) {
+	result = make(chan error, 1)
+	go func() {
+		_, _, err := client.SendRequest(keepaliveRequest, true, nil)
+		result <- err
+	}()
+	return result
+}
+
+// needsProbe reports whether the client must be probed before being handed out
+func (c *Client) needsProbe() (probe bool) {
+	within := c.mgr.health.SkipProbeWithin
+	return within <= 0 || time.Since(time.Unix(0, atomic.LoadInt64(&c.alive))) >= within
+}
+
+func (c *Client) markAlive() {
+	atomic.StoreInt64(&c.alive, time.Now().UnixNano())
+}
+
+// keepalive sends keepalives at the configured interval until the transport identified
+// by done is closed, removing the client after CountMax consecutive missed replies.
+// A single keepalive is outstanding at a time, a keepalive without reply after
+// the probe timeout is counted as missed on every interval until it is answered
+func (c *Client) keepalive(client *ssh.Client, done chan struct{}) {
+	health := c.mgr.health
+	countMax := health.CountMax
+	if countMax <= 0 {
+		countMax = 3
+	}
+
+	timeout := health.ProbeTimeout
+	if timeout <= 0 {
+		timeout = health.Interval
+	}
+
+	ticker := time.NewTicker(health.Interval)
+	defer ticker.Stop()
+
+	var pending chan error
+	var sent time.Time
+	missed := 0
+	for {
+		select {
+		case <-done:
+			return
+
+		case err := <-pending:
+			pending = nil
+			if err != nil {
+				missed++
+				c.log.Warn("keepalive failed", slog.Int("missed", missed), slog.Any("error", err))
+				break
+			}
+			missed = 0
+			c.markAlive()
+			continue
+
+		case <-ticker.C:
+			if pending == nil {
+				pending, sent = sendKeepalive(client), time.Now()
+				continue
+			}
+			if time.Since(sent) < timeout {
+				continue
+			}
+			missed++
+			c.log.Warn("keepalive without reply", slog.Int("missed", missed))
+		}
+
+		if missed >= countMax {
+			c.log.Error("client unresponsive, removing", slog.Int("missed", missed))
+			c.discard(done)
+			return
+		}
+	}
+}
+
+// watch removes the client from the manager once the transport client is closed
+func (c *Client) watch(client *ssh.Client, done chan struct{}) {
+	err := client.Wait()
+
+	select {
+	case <-done:
+		return
+	default:
+	}
+
+	c.log.Warn("connection lost, removing client", slog.Any("error", err))
+	c.discard(done)
+}
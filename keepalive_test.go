@@ -0,0 +1,128 @@
+package sshmgr
+
+import (
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// waitFor polls cond until it is true or fails the test after timeout
+func waitFor(t *testing.T, timeout time.Duration, msg string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(timeout)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatal(msg)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestKeepaliveCountMax(t *testing.T) {
+	server := newTestServer(t)
+	manager := New(time.Minute, time.Minute,
+		WithHealthCheck(HealthCheck{Interval: 20 * time.Millisecond, CountMax: 3}))
+	defer manager.Close()
+
+	client, err := manager.SSHClient(server.clientConfig())
+	if err != nil {
+		t.Fatal(err)
+	}
+	client.Close()
+
+	// Answered keepalives keep the client alive
+	time.Sleep(100 * time.Millisecond)
+	if client.isClosed() {
+		t.Fatal("expected client with answered keepalives to be kept")
+	}
+
+	server.nokeepalive.Store(true)
+	start := time.Now()
+	waitFor(t, 2*time.Second, "expected unresponsive client to be removed", client.isClosed)
+
+	if elapsed := time.Since(start); elapsed < 60*time.Millisecond {
+		t.Fatalf("expected client to be removed after CountMax missed keepalives, removed after %v", elapsed)
+	}
+
+	if stats := manager.Stats(); stats.Clients != 0 || stats.Connections != 0 {
+		t.Fatalf("unexpected stats: %+v", stats)
+	}
+}
+
+func TestProbeSkipAndTimeout(t *testing.T) {
+	server := newTestServer(t)
+	manager := New(time.Minute, time.Minute,
+		WithHealthCheck(HealthCheck{ProbeTimeout: 50 * time.Millisecond, SkipProbeWithin: time.Minute}))
+	defer manager.Close()
+
+	client, err := manager.SSHClient(server.clientConfig())
+	if err != nil {
+		t.Fatal(err)
+	}
+	client.Close()
+
+	// The probe is skipped as the client was recently seen alive
+	server.nokeepalive.Store(true)
+	reused, err := manager.SSHClient(server.clientConfig())
+	if err != nil {
+		t.Fatal(err)
+	}
+	reused.Close()
+	if reused != client {
+		t.Fatal("expected recently alive client to be reused without a probe")
+	}
+
+	// Probes timing out close the transport and a new client is dialed
+	atomic.StoreInt64(&client.alive, 0)
+	fresh, err := manager.SSHClient(server.clientConfig())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fresh.Close()
+
+	if fresh == client {
+		t.Fatal("expected a new client after the probe timed out")
+	}
+
+	sc, _ := client.transport()
+	done := make(chan struct{})
+	go func() {
+		sc.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("expected transport of the timed out probe to be closed")
+	}
+
+	if stats := manager.Stats(); stats.Clients != 1 || stats.Connections != 1 {
+		t.Fatalf("unexpected stats: %+v", stats)
+	}
+}
+
+func TestDiscardOnTransportLoss(t *testing.T) {
+	server := newTestServer(t)
+	manager := New(time.Minute, time.Minute)
+	defer manager.Close()
+
+	client, err := manager.SSHClient(server.clientConfig())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	client.conn.Close()
+	waitFor(t, 2*time.Second, "expected client to be removed on transport loss", func() bool {
+		return manager.Stats().Clients == 0
+	})
+
+	if !client.isClosed() {
+		t.Fatal("expected lost client to be closed")
+	}
+
+	if stats := manager.Stats(); stats.Connections != 0 {
+		t.Fatalf("expected the connection slot to be released, got: %+v", stats)
+	}
+}
@@ -0,0 +1,124 @@
+package sshmgr
+
+import (
+	"context"
+	"sync"
+)
+
+// limits bounds the number of open connections, in progress dials and
+// connections per host. Callers wait when a limit is reached until a slot
+// is released or their context is done. A limit <= 0 is unbounded
+type limits struct {
+	mtx        sync.Mutex
+	maxConns   int
+	maxDials   int
+	maxPerHost int
+	conns      int
+	dials      int
+	waiting    int
+	hosts      map[string]int
+	wake       chan struct{}
+}
+
+func newLimits() (l *limits) {
+	return &limits{hosts: map[string]int{}, wake: make(chan struct{})}
+}
+
+// acquireConn reserves a connection slot for host. When no slot is available
+// evict is called to make room by closing idle connections, receiving host
+// when the per host limit is reached or an empty string for the global limit
+func (l *limits) acquireConn(ctx context.Context, host string, evict func(host string) bool) (err error) {
+	for {
+		l.mtx.Lock()
+		global := l.maxConns > 0 && l.conns >= l.maxConns
+		perHost := l.maxPerHost > 0 && l.hosts[host] >= l.maxPerHost
+		if !global && !perHost {
+			l.conns++
+			l.hosts[host]++
+			l.mtx.Unlock()
+			return nil
+		}
+		wake := l.wake
+		l.mtx.Unlock()
+
+		scope := ""
+		if perHost {
+			scope = host
+		}
+		if evict(scope) {
+			continue
+		}
+
+		if err = l.wait(ctx, wake); err != nil {
+			return err
+		}
+	}
+}
+
+// releaseConn releases a connection slot for host
+func (l *limits) releaseConn(host string) {
+	l.mtx.Lock()
+	l.conns--
+	if l.hosts[host]--; l.hosts[host] <= 0 {
+		delete(l.hosts, host)
+	}
+	l.broadcast()
+	l.mtx.Unlock()
+}
+
+// acquireDial reserves a slot for an in progress dial and handshake
+func (l *limits) acquireDial(ctx context.Context) (err error) {
+	for {
+		l.mtx.Lock()
+		if l.maxDials <= 0 || l.dials < l.maxDials {
+			l.dials++
+			l.mtx.Unlock()
+			return nil
+		}
+		wake := l.wake
+		l.mtx.Unlock()
+
+		if err = l.wait(ctx, wake); err != nil {
+			return err
+		}
+	}
+}
+
+// releaseDial releases a dial slot
+func (l *limits) releaseDial() {
+	l.mtx.Lock()
+	l.dials--
+	l.broadcast()
+	l.mtx.Unlock()
+}
+
+// wait blocks until wake is closed or ctx is done
+func (l *limits) wait(ctx context.Context, wake chan struct{}) (err error) {
+	l.mtx.Lock()
+	l.waiting++
+	l.mtx.Unlock()
+
+	select {
+	case <-ctx.Done():
+		err = ctx.Err()
+	case <-wake:
+	}
+
+	l.mtx.Lock()
+	l.waiting--
+	l.mtx.Unlock()
+	return err
+}
+
+// broadcast wakes all waiters, must be called with l.mtx held
+func (l *limits) broadcast() {
+	close(l.wake)
+	l.wake = make(chan struct{})
+}
+
+// stats returns the number of open connections, in progress dials and waiting callers
+func (l *limits) stats() (conns, dials, waiting int) {
+	l.mtx.Lock()
+	defer l.mtx.Unlock()
+	return l.conns, l.dials, l.waiting
+}
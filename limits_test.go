@@ -0,0 +1,71 @@
+package sshmgr
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestLimitsPerHost(t *testing.T) {
+	l := newLimits()
+	l.maxPerHost = 1
+	noEvict := func(string) bool { return false }
+
+	if err := l.acquireConn(context.Background(), "hosta:22", noEvict); err != nil {
+		t.Fatal(err)
+	}
+
+	// other hosts are not affected by the per host limit
+	if err := l.acquireConn(context.Background(), "hostb:22", noEvict); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if err := l.acquireConn(ctx, "hosta:22", noEvict); err != context.DeadlineExceeded {
+		t.Fatalf("expected caller to wait until deadline, got: %v", err)
+	}
+
+	done := make(chan error)
+	go func() {
+		done <- l.acquireConn(context.Background(), "hosta:22", noEvict)
+	}()
+
+	l.releaseConn("hosta:22")
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(3 * time.Second):
+		t.Fatal("waiting caller was not woken on release")
+	}
+}
+
+func TestLimitsEvict(t *testing.T) {
+	l := newLimits()
+	l.maxConns = 1
+
+	if err := l.acquireConn(context.Background(), "hosta:22", nil); err != nil {
+		t.Fatal(err)
+	}
+
+	var scope string
+	evict := func(host string) bool {
+		scope = host
+		l.releaseConn("hosta:22")
+		return true
+	}
+
+	if err := l.acquireConn(context.Background(), "hostb:22", evict); err != nil {
+		t.Fatal(err)
+	}
+
+	if scope != "" {
+		t.Fatalf("expected global eviction, got host scope: %s", scope)
+	}
+
+	if conns, _, _ := l.stats(); conns != 1 {
+		t.Fatalf("expected 1 connection, got: %d", conns)
+	}
+}
@@ -0,0 +1,88 @@
+package sshmgr
+
+import (
+	"context"
+	"log/slog"
+	"strings"
+)
+
+// redacted is logged in place of secret attribute values
+const redacted = "[REDACTED]"
+
+// secretKeys are attribute keys whose values are never logged
+var secretKeys = map[string]bool{
+	"password":   true,
+	"passphrase": true,
+	"key":        true,
+	"privatekey": true,
+	"secret":     true,
+}
+
+// LogValue implements slog.LogValuer so a ClientConfig can be safely logged,
+// only the connection identity is reported and credentials are omitted
+func (c ClientConfig) LogValue() (v slog.Value) {
+	return slog.GroupValue(
+		slog.String("host", c.NetAddr),
+		slog.String("port", c.Port),
+		slog.String("user", c.User),
+	)
+}
+
+// newLogger wraps the handler of the given logger with secret redaction.
+// A nil logger discards all records
+func newLogger(l *slog.Logger) (logger *slog.Logger) {
+	if l == nil {
+		return slog.New(slog.DiscardHandler)
+	}
+	return slog.New(redactHandler{l.Handler()})
+}
+
+// clientLogger returns a logger carrying the host and user fields of config
+func clientLogger(l *slog.Logger, config ClientConfig) (logger *slog.Logger) {
+	return l.With(slog.String("host", config.NetAddr), slog.String("user", config.User))
+}
+
+// redactHandler is a slog.Handler that replaces the values of secret attributes
+type redactHandler struct {
+	slog.Handler
+}
+
+func (h redactHandler) Handle(ctx context.Context, r slog.Record) (err error) {
+	nr := slog.NewRecord(r.Time, r.Level, r.Message, r.PC)
+	r.Attrs(func(a slog.Attr) bool {
+		nr.AddAttrs(redactAttr(a))
+		return true
+	})
+	return h.Handler.Handle(ctx, nr)
+}
+
+func (h redactHandler) WithAttrs(attrs []slog.Attr) (handler slog.Handler) {
+	redactedAttrs := make([]slog.Attr, len(attrs))
+	for i := range attrs {
+		redactedAttrs[i] = redactAttr(attrs[i])
+	}
+	return redactHandler{h.Handler.WithAttrs(redactedAttrs)}
+}
+
+func (h redactHandler) WithGroup(name string) (handler slog.Handler) {
+	return redactHandler{h.Handler.WithGroup(name)}
+}
+
+// redactAttr replaces the value of secret attributes, descending into groups
+func redactAttr(a slog.Attr) (r slog.Attr) {
+	if secretKeys[strings.ToLower(a.Key)] {
+		return slog.String(a.Key, redacted)
+	}
+
+	a.Value = a.Value.Resolve()
+	if a.Value.Kind() != slog.KindGroup {
+		return a
+	}
+
+	group := a.Value.Group()
+	attrs := make([]slog.Attr, len(group))
+	for i := range group {
+		attrs[i] = redactAttr(group[i])
+	}
+	return slog.Attr{Key: a.Key, Value: slog.GroupValue(attrs...)}
+}
@@ -0,0 +1,27 @@
+package sshmgr
+
+import (
+	"bytes"
+	"log/slog"
+	"strings"
+	"testing"
+)
+
+func TestLoggerRedaction(t *testing.T) {
+	buf := &bytes.Buffer{}
+	log := newLogger(slog.New(slog.NewTextHandler(buf, nil)))
+
+	config := ClientConfig{NetAddr: "hosta", User: "root", Password: "hunter2", Key: []byte("PRIVATE")}
+	log.With(slog.String("password", config.Password)).Info("test",
+		slog.Any("config", config),
+		slog.Group("auth", slog.String("key", string(config.Key))))
+
+	out := buf.String()
+	if strings.Contains(out, "hunter2") || strings.Contains(out, "PRIVATE") {
+		t.Fatalf("secrets were logged: %s", out)
+	}
+
+	if !strings.Contains(out, "config.host=hosta") || !strings.Contains(out, "config.user=root") {
+		t.Fatalf("expected host and user fields, got: %s", out)
+	}
+}
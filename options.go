@@ -0,0 +1,97 @@
+package sshmgr
+
+import (
+	"log/slog"
+	"time"
+)
+
+// Option configures optional Manager behaviour
+type Option func(m *Manager)
+
+// WithLogger sets the logger used by the manager and its clients.
+// Secret attributes as passwords and keys are redacted from all records.
+// Managers are silent by default
+func WithLogger(logger *slog.Logger) (option Option) {
+	return func(m *Manager) {
+		m.log = newLogger(logger)
+	}
+}
+
+// WithTracer sets the tracer used to create spans around locker waits, dials,
+// handshakes, liveness probes, session opens, commands and SFTP operations
+func WithTracer(tracer Tracer) (option Option) {
+	return func(m *Manager) {
+		if tracer != nil {
+			m.tracer = tracer
+		}
+	}
+}
+
+// WithCircuitBreaker enables a per host circuit breaker. After threshold consecutive
+// dial or handshake failures, acquiring clients for the host fails fast with a
+// *CircuitOpenError for cooldown, after which a single probe dial is allowed.
+// The cooldown doubles on every consecutive failed probe up to maxCooldown
+func WithCircuitBreaker(threshold int, cooldown, maxCooldown time.Duration) (option Option) {
+	return func(m *Manager) {
+		m.breakers.threshold = threshold
+		m.breakers.cooldown = cooldown
+		m.breakers.maxCooldown = maxCooldown
+	}
+}
+
+// WithConnectionLimits bounds the total number of open connections, the number of
+// concurrent dials and handshakes and the number of connections per host.
+// When a limit is reached idle clients are evicted in least recently used order
+// to make room, otherwise callers wait until a slot is released or their context
+// is done. A limit <= 0 is unbounded
+func WithConnectionLimits(total, dials, perHost int) (option Option) {
+	return func(m *Manager) {
+		m.limits.maxConns = total
+		m.limits.maxDials = dials
+		m.limits.maxPerHost = perHost
+	}
+}
+
+// WithMaxSessions sets the number of concurrent sessions opened on a single
+// connection, matching the server MaxSessions. Sessions beyond the limit are
+// transparently opened on additional connections for the same config, which are
+// closed by the manager gc once idle. Defaults to 10, a value <= 0 disables the limit
+func WithMaxSessions(n int) (option Option) {
+	return func(m *Manager) {
+		m.maxSessions = n
+	}
+}
+
+// WithHealthCheck configures background keepalives, the liveness probe timeout
+// and probe skipping for clients. Clients are probed on every acquisition and
+// keepalives are disabled by default
+func WithHealthCheck(health HealthCheck) (option Option) {
+	return func(m *Manager) {
+		m.health = health
+	}
+}
+
+// WithRetryPolicy enables the resilient client mode. Idempotent operations that
+// fail due to a dead transport redial the client through the manager and are
+// retried according to policy. Holders of the client keep using the same *Client
+func WithRetryPolicy(policy RetryPolicy) (option Option) {
+	return func(m *Manager) {
+		m.retry = policy
+	}
+}
+
+// WithDialer sets the default dialer for clients without a ClientConfig.Dialer
+func WithDialer(dialer Dialer) (option Option) {
+	return func(m *Manager) {
+		m.dialer = dialer
+	}
+}
+
+// WithRateLimit bounds the total bandwidth of the SFTP transfers and command streams
+// of all clients in bytes per second, shared between them. Transfers and streams
+// can be further limited individually. Unlimited by default
+func WithRateLimit(bytesPerSecond int64) (option Option) {
+	return func(m *Manager) {
+		m.rateLimit = newRateLimiter(bytesPerSecond)
+	}
+}
@@ -0,0 +1,133 @@
+package sshmgr
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log/slog"
+	"net"
+	"os"
+	"time"
+
+	"github.com/pkg/sftp"
+	"golang.org/x/crypto/ssh"
+)
+
+// RetryPolicy configures the resilient client mode. When an idempotent operation
+// (session open, SFTP stat, lstat, readdir, readlink, glob, getwd, statvfs, open
+// for reading, mkdirall and attribute changes) fails because the transport is dead,
+// the client is redialed through the manager and the operation retried.
+// Other SFTP operations are not retried but use a session on the new transport
+// once the client was reconnected
+type RetryPolicy struct {
+	// MaxAttempts is the maximum number of attempts of an operation,
+	// including the first one. Operations are not retried if <= 1
+	MaxAttempts int
+
+	// Backoff is the wait before the first retry, doubled on each retry
+	Backoff time.Duration
+
+	// MaxBackoff caps the wait between retries if not zero
+	MaxBackoff time.Duration
+}
+
+// retry runs fn according to the manager retry policy,
+// reconnecting the client when fn fails due to a dead transport
+func (c *Client) retry(ctx context.Context, op string, fn func() error) (err error) {
+	policy := c.mgr.retry
+	backoff := policy.Backoff
+
+	for attempt := 1; ; attempt++ {
+		if err = fn(); err == nil || attempt >= policy.MaxAttempts || !c.transportFailed(err) {
+			return err
+		}
+
+		c.log.Warn("operation failed on dead transport, reconnecting",
+			slog.String("op", op), slog.Int("attempt", attempt), slog.Any("error", err))
+
+		timer := time.NewTimer(backoff)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return errors.Join(err, ctx.Err())
+		case <-timer.C:
+		}
+
+		if backoff *= 2; policy.MaxBackoff > 0 && backoff > policy.MaxBackoff {
+			backoff = policy.MaxBackoff
+		}
+
+		if rerr := c.reconnect(ctx); rerr != nil {
+			c.log.Error("reconnect failed", slog.Int("attempt", attempt), slog.Any("error", rerr))
+		}
+	}
+}
+
+// transportFailed reports whether err was caused by a dead transport
+// rather than by the remote operation itself
+func (c *Client) transportFailed(err error) (failed bool) {
+	var status *sftp.StatusError
+	var openErr *ssh.OpenChannelError
+	switch {
+	case errors.As(err, &status), errors.As(err, &openErr),
+		errors.Is(err, os.ErrNotExist), errors.Is(err, os.ErrPermission):
+		return false
+	case c.isClosed(), errors.Is(err, io.EOF), errors.Is(err, net.ErrClosed):
+		return true
+	}
+
+	return c.probe(c.probeTimeout()) != nil
+}
+
+// reconnect replaces a dead transport with a new connection for the same config,
+// keeping the client references so holders of the client are unaffected
+func (c *Client) reconnect(ctx context.Context) (err error) {
+	m := c.mgr
+	m.locker.Lock(c.id)
+	defer m.locker.Unlock(c.id)
+
+	// Another holder may have already reconnected the client
+	if !c.isClosed() {
+		if c.probe(c.probeTimeout()) == nil {
+			return nil
+		}
+		_, done := c.transport()
+		c.discard(done)
+	}
+
+	if err = m.breakers.allow(c.addr, time.Now()); err != nil {
+		return err
+	}
+
+	nc, err := m.newClient(ctx, c.config)
+	if err != nil {
+		return err
+	}
+
+	// The new transport takes over the connection slot reserved by newClient
+	c.mtx.Lock()
+	c.client, c.conn, c.done, c.algos = nc.client, nc.conn, nc.done, nc.algos
+	c.closed, c.err = false, nil
+	c.mtx.Unlock()
+	c.markAlive()
+
+	m.delClient(c)
+	if err = m.addClient(c); err != nil {
+		c.close()
+		return err
+	}
+
+	c.start()
+	c.setDeadline(c.config.ConnDeadline)
+	c.log.Info("client reconnected")
+	return nil
+}
+
+// probeTimeout returns the configured probe timeout, bounded to avoid
+// blocking indefinitely on a silently dead transport while checking for failures
+func (c *Client) probeTimeout() (timeout time.Duration) {
+	if timeout = c.mgr.health.ProbeTimeout; timeout <= 0 {
+		timeout = defaultProbeTimeout
+	}
+	return timeout
+}
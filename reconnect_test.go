@@ -0,0 +1,115 @@
+package sshmgr
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestResilientClient(t *testing.T) {
+	server := newTestServer(t)
+	manager := New(time.Minute, time.Minute,
+		WithRetryPolicy(RetryPolicy{MaxAttempts: 3, Backoff: 10 * time.Millisecond}))
+	defer manager.Close()
+
+	session, err := manager.SFTPClient(server.clientConfig())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer session.Close()
+
+	dir := t.TempDir()
+	name := filepath.Join(dir, "a.txt")
+	if err = os.WriteFile(name, []byte("contents"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	conn := session.connection()
+	kill := func() {
+		conn.mtx.RLock()
+		conn.conn.Close()
+		conn.mtx.RUnlock()
+	}
+
+	// Idempotent operations reconnect the client and move to a new session
+	kill()
+	if _, err = session.Stat(name); err != nil {
+		t.Fatalf("expected stat to be retried, got: %v", err)
+	}
+
+	if session.connection() != conn {
+		t.Fatal("expected the session to stay on the reconnected client")
+	}
+	if n := atomic.LoadInt64(&server.sftps); n != 2 {
+		t.Fatalf("expected a sftp session on the new transport, got %d opened", n)
+	}
+
+	kill()
+	f, err := session.Open(name)
+	if err != nil {
+		t.Fatalf("expected open to be retried, got: %v", err)
+	}
+	data, err := io.ReadAll(f)
+	f.Close()
+	if err != nil || string(data) != "contents" {
+		t.Fatalf("unexpected contents %q: %v", data, err)
+	}
+
+	// Sessions and new handles are available on the reconnected client
+	kill()
+	client, err := manager.SSHClient(server.clientConfig())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	if out, err := client.CombinedOutput("printf ok", nil); err != nil || string(out) != "ok" {
+		t.Fatalf("expected session open to be retried, got %q: %v", out, err)
+	}
+
+	other, err := manager.SFTPClient(server.clientConfig())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = other.Getwd(); err != nil {
+		t.Fatal(err)
+	}
+	other.Close()
+
+	// Non idempotent operations fail without being retried
+	if _, err = session.Stat(name); err != nil {
+		t.Fatal(err)
+	}
+	kill()
+	if err = session.Mkdir(filepath.Join(dir, "sub")); err == nil {
+		t.Fatal("expected mkdir on a dead transport to fail")
+	}
+	if err = session.Remove(name); err == nil {
+		t.Fatal("expected remove on a dead transport to fail")
+	}
+	if _, err = os.Stat(name); err != nil {
+		t.Fatalf("expected the file to be kept: %v", err)
+	}
+	if _, err = os.Stat(filepath.Join(dir, "sub")); !os.IsNotExist(err) {
+		t.Fatalf("expected mkdir not to be retried, got: %v", err)
+	}
+
+	// A later idempotent operation recovers the session for other operations
+	if _, err = session.ReadDir(dir); err != nil {
+		t.Fatal(err)
+	}
+	if err = session.Mkdir(filepath.Join(dir, "sub")); err != nil {
+		t.Fatal(err)
+	}
+
+	// The sftp client of the recovered session is available for unwrapped operations
+	sftpClient, err := session.Client()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = sftpClient.Stat(filepath.Join(dir, "sub")); err != nil {
+		t.Fatal(err)
+	}
+}
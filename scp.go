@@ -0,0 +1,457 @@
+package sshmgr
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// SCPUpload copies the local file or directory tree at local to remote with the scp
+// protocol, for hosts without a sftp subsystem. It follows the semantics of
+// SFTPClient.Upload, except that scp cannot create symbolic links so links are
+// skipped unless followed, and preserved modes are applied along with times
+func (c *Client) SCPUpload(ctx context.Context, local, remote string, options TransferOptions) (err error) {
+	ctx, span := c.tracer.Start(ctx, "sshmgr.scp.upload", c.attrs...)
+	defer func() { endSpan(span, err) }()
+
+	info, err := os.Stat(local)
+	if err != nil {
+		return err
+	}
+
+	flags := scpFlags(options)
+	progress := newProgressTracker(options.Progress, local, 0)
+	m := &meter{ctx: ctx, limits: c.mgr.limiters(options.RateLimit), progress: progress}
+
+	if !info.IsDir() {
+		progress.grow(info.Size())
+		cmd := fmt.Sprintf("scp%s -t -- %s", flags, shellQuote(path.Dir(remote)))
+		err = c.scp(ctx, cmd, m, func(p *scpConn) (err error) {
+			if err = p.ack(); err != nil {
+				return err
+			}
+			return p.sendFile(local, path.Base(remote), info, options)
+		})
+		if err != nil || !options.Verify {
+			return err
+		}
+		return c.verify(ctx, []verifiedFile{{local: local, remote: remote}}, true)
+	}
+
+	tree, err := listTree(localFS{}, local, options)
+	if err != nil {
+		return err
+	}
+
+	var rels []string
+	for _, rel := range sortedKeys(tree) {
+		if e := tree[rel]; e.target != "" {
+			c.log.Warn("skipping symlink unsupported by scp", slog.String("path", e.path))
+			continue
+		}
+		rels = append(rels, rel)
+	}
+
+	// With Include patterns directories are only sent if they hold files, as by Upload
+	var pruned map[string]bool
+	if len(options.Include) > 0 {
+		pruned = prunedDirs(tree, rels)
+	}
+
+	var files []verifiedFile
+	children := map[string][]string{}
+	for _, rel := range rels {
+		e := tree[rel]
+		if pruned[rel] {
+			continue
+		}
+		if !e.info.IsDir() {
+			progress.grow(e.info.Size())
+			files = append(files, verifiedFile{local: e.path, remote: path.Join(remote, rel)})
+		}
+		parent := path.Dir(rel)
+		children[parent] = append(children[parent], rel)
+	}
+
+	cmd := fmt.Sprintf("mkdir -p -- %[1]s && scp -r%[2]s -t -- %[1]s", shellQuote(remote), flags)
+	err = c.scp(ctx, cmd, m, func(p *scpConn) (err error) {
+		if err = p.ack(); err != nil {
+			return err
+		}
+		return p.sendDir(tree, children, ".", options)
+	})
+	if err != nil || !options.Verify {
+		return err
+	}
+	return c.verify(ctx, files, true)
+}
+
+// SCPDownload copies the remote file or directory tree at remote to local with the
+// scp protocol, for hosts without a sftp subsystem. It follows the semantics of
+// SFTPClient.Download, except that the remote scp follows symbolic links
+func (c *Client) SCPDownload(ctx context.Context, remote, local string, options TransferOptions) (err error) {
+	ctx, span := c.tracer.Start(ctx, "sshmgr.scp.download", c.attrs...)
+	defer func() { endSpan(span, err) }()
+
+	m := &meter{ctx: ctx, limits: c.mgr.limiters(options.RateLimit),
+		progress: newProgressTracker(options.Progress, remote, 0)}
+
+	var received []string
+	cmd := fmt.Sprintf("scp -r%s -f -- %s", scpFlags(options), shellQuote(remote))
+	err = c.scp(ctx, cmd, m, func(p *scpConn) error {
+		err := p.receive(local, options)
+		received = p.received
+		return err
+	})
+	if err != nil || !options.Verify {
+		return err
+	}
+	return c.verify(ctx, verifiedTree(local, remote, received), false)
+}
+
+// scpFlags returns the scp flags preserving attributes if requested
+func scpFlags(options TransferOptions) (flags string) {
+	if options.PreservePermissions || options.PreserveTimes {
+		return " -p"
+	}
+	return ""
+}
+
+// scp runs the remote scp cmd and speaks the protocol with fn
+func (c *Client) scp(ctx context.Context, cmd string, m *meter, fn func(p *scpConn) error) (err error) {
+	c.log.Debug("running scp", slog.String("cmd", cmd))
+	return c.exchange(ctx, cmd, func(stdin io.Writer, stdout io.Reader) error {
+		return fn(&scpConn{w: stdin, r: bufio.NewReader(stdout), m: m, log: c.log})
+	})
+}
+
+// scpConn speaks the scp protocol with a remote scp in source or sink mode
+type scpConn struct {
+	w        io.Writer
+	r        *bufio.Reader
+	m        *meter
+	log      *slog.Logger
+	received []string
+}
+
+// send writes a protocol line and waits for its acknowledgement
+func (p *scpConn) send(format string, args ...any) (err error) {
+	if _, err = fmt.Fprintf(p.w, format, args...); err != nil {
+		return err
+	}
+	return p.ack()
+}
+
+// ack reads an acknowledgement, failing with the error message sent by the remote scp
+func (p *scpConn) ack() (err error) {
+	b, err := p.r.ReadByte()
+	if err != nil {
+		return fmt.Errorf("scp: %w", noEOF(err))
+	}
+
+	if b == 0 {
+		return nil
+	}
+
+	msg, _ := p.r.ReadString('\n')
+	return fmt.Errorf("scp: %s", strings.TrimSpace(msg))
+}
+
+// ok acknowledges a protocol line
+func (p *scpConn) ok() (err error) {
+	_, err = p.w.Write([]byte{0})
+	return err
+}
+
+// sendTimes sends the modification time of info if preserved
+func (p *scpConn) sendTimes(info os.FileInfo, options TransferOptions) (err error) {
+	if !options.PreserveTimes {
+		return nil
+	}
+	mtime := info.ModTime().Unix()
+	return p.send("T%d 0 %d 0\n", mtime, mtime)
+}
+
+// sendFile sends the local file src as name
+func (p *scpConn) sendFile(src, name string, info os.FileInfo, options TransferOptions) (err error) {
+	if err = scpValidName(name); err != nil {
+		return err
+	}
+
+	f, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	if err = p.sendTimes(info, options); err != nil {
+		return err
+	}
+
+	mode := os.FileMode(0644)
+	if options.PreservePermissions {
+		mode = info.Mode().Perm()
+	}
+
+	size := info.Size()
+	if err = p.send("C%04o %d %s\n", mode, size, name); err != nil {
+		return fmt.Errorf("%s: %w", src, err)
+	}
+
+	p.m.path = src
+	n, err := io.Copy(p.w, p.m.reader(io.LimitReader(f, size)))
+	if err == nil && n != size {
+		err = fmt.Errorf("%s: file changed size during transfer", src)
+	}
+	if err != nil {
+		return err
+	}
+
+	if err = p.ok(); err != nil {
+		return err
+	}
+	return p.ack()
+}
+
+// sendDir sends the entries of the tree under the directory rel
+func (p *scpConn) sendDir(tree map[string]treeEntry, children map[string][]string, rel string,
+	options TransferOptions) (err error) {
+
+	for _, crel := range children[rel] {
+		e := tree[crel]
+		if !e.info.IsDir() {
+			if err = p.sendFile(e.path, e.info.Name(), e.info, options); err != nil {
+				return err
+			}
+			continue
+		}
+
+		if err = scpValidName(e.info.Name()); err != nil {
+			return err
+		}
+
+		if err = p.sendTimes(e.info, options); err != nil {
+			return err
+		}
+
+		mode := os.FileMode(0755)
+		if options.PreservePermissions {
+			mode = e.info.Mode().Perm()
+		}
+
+		if err = p.send("D%04o 0 %s\n", mode, e.info.Name()); err != nil {
+			return fmt.Errorf("%s: %w", e.path, err)
+		}
+
+		if err = p.sendDir(tree, children, crel, options); err != nil {
+			return err
+		}
+
+		if err = p.send("E\n"); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// scpDir is a directory being received
+type scpDir struct {
+	path  string
+	rel   string
+	skip  bool
+	mode  os.FileMode
+	mtime time.Time
+}
+
+// receive reads the file or directory tree sent by a remote scp in source mode
+// into root, returning once its top level entry is complete
+func (p *scpConn) receive(root string, options TransferOptions) (err error) {
+	var dirs []scpDir
+	var mtime time.Time
+	var warning string
+
+	if err = p.ok(); err != nil {
+		return err
+	}
+
+	for {
+		b, err := p.r.ReadByte()
+		if err == io.EOF && warning != "" {
+			return fmt.Errorf("scp: %s", warning)
+		}
+		if err != nil {
+			return fmt.Errorf("scp: %w", noEOF(err))
+		}
+
+		line, err := p.r.ReadString('\n')
+		if err != nil {
+			return fmt.Errorf("scp: %w", noEOF(err))
+		}
+		line = strings.TrimSuffix(line, "\n")
+
+		switch b {
+		case 1:
+			warning = line
+			p.log.Warn("scp warning", slog.String("message", line))
+			continue
+
+		case 2:
+			return fmt.Errorf("scp: %s", line)
+
+		case 'T':
+			fields := strings.Fields(line)
+			if len(fields) != 4 {
+				return fmt.Errorf("scp: invalid times %q", line)
+			}
+			sec, err := strconv.ParseInt(fields[0], 10, 64)
+			if err != nil {
+				return fmt.Errorf("scp: invalid times %q", line)
+			}
+			mtime = time.Unix(sec, 0)
+
+		case 'E':
+			if len(dirs) == 0 {
+				return fmt.Errorf("scp: unexpected end of directory")
+			}
+			dir := dirs[len(dirs)-1]
+			dirs = dirs[:len(dirs)-1]
+			if !dir.skip {
+				if err = localAttributes(dir.path, dir.mode, dir.mtime, options); err != nil {
+					return err
+				}
+			}
+
+		case 'C', 'D':
+			mode, size, name, err := scpParseEntry(line)
+			if err != nil {
+				return err
+			}
+
+			target, rel, skip := root, "", false
+			if len(dirs) > 0 {
+				parent := dirs[len(dirs)-1]
+				target, rel = filepath.Join(parent.path, name), path.Join(parent.rel, name)
+				skip = parent.skip || !options.match(rel, b == 'D')
+			}
+
+			if b == 'D' {
+				if !skip {
+					if err = os.MkdirAll(target, 0755); err != nil {
+						return err
+					}
+				}
+				dirs = append(dirs, scpDir{path: target, rel: rel, skip: skip, mode: mode, mtime: mtime})
+				break
+			}
+
+			if err = p.ok(); err != nil {
+				return err
+			}
+			if err = p.receiveFile(target, size, skip); err != nil {
+				return err
+			}
+			if !skip {
+				if err = localAttributes(target, mode, mtime, options); err != nil {
+					return err
+				}
+				p.received = append(p.received, rel)
+			}
+
+		default:
+			return fmt.Errorf("scp: unexpected protocol line %q", string(b)+line)
+		}
+
+		if b != 'T' {
+			mtime = time.Time{}
+		}
+
+		if err = p.ok(); err != nil {
+			return err
+		}
+
+		// A single path is requested, so the transfer completes with its entry
+		if len(dirs) == 0 && b != 'T' {
+			return nil
+		}
+	}
+}
+
+// receiveFile reads size bytes of file contents into target, or discards them if skipped
+func (p *scpConn) receiveFile(target string, size int64, skip bool) (err error) {
+	var w io.Writer = io.Discard
+	var f *os.File
+	if !skip {
+		if f, err = os.Create(target); err != nil {
+			return err
+		}
+		defer f.Close()
+		w = f
+		p.m.progress.grow(size)
+	}
+
+	p.m.path = target
+	n, err := io.Copy(w, p.m.reader(io.LimitReader(p.r, size)))
+	if err == nil && n != size {
+		err = io.ErrUnexpectedEOF
+	}
+	if err != nil {
+		return err
+	}
+
+	if err = p.ack(); err != nil {
+		return err
+	}
+
+	if f != nil {
+		return f.Close()
+	}
+	return nil
+}
+
+// scpParseEntry parses a file or directory line holding the mode, size and name
+func scpParseEntry(line string) (mode os.FileMode, size int64, name string, err error) {
+	fields := strings.SplitN(line, " ", 3)
+	if len(fields) != 3 {
+		return 0, 0, "", fmt.Errorf("scp: invalid entry %q", line)
+	}
+
+	perm, err := strconv.ParseUint(fields[0], 8, 32)
+	if err != nil {
+		return 0, 0, "", fmt.Errorf("scp: invalid mode %q", line)
+	}
+
+	if size, err = strconv.ParseInt(fields[1], 10, 64); err != nil || size < 0 {
+		return 0, 0, "", fmt.Errorf("scp: invalid size %q", line)
+	}
+
+	name = fields[2]
+	if err = scpValidName(name); err != nil {
+		return 0, 0, "", err
+	}
+	return os.FileMode(perm).Perm(), size, name, nil
+}
+
+// scpValidName rejects names escaping the target directory or breaking the protocol
+func scpValidName(name string) (err error) {
+	if name == "" || name == "." || name == ".." || strings.ContainsAny(name, "/\n") {
+		return fmt.Errorf("scp: invalid file name %q", name)
+	}
+	return nil
+}
+
+// noEOF reports a premature end of the protocol stream as io.ErrUnexpectedEOF
+func noEOF(err error) error {
+	if errors.Is(err, io.EOF) {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
@@ -0,0 +1,96 @@
+package sshmgr
+
+import (
+	"context"
+	"errors"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestSCPFallback(t *testing.T) {
+	if _, err := exec.LookPath("scp"); err != nil {
+		t.Skip("scp not installed")
+	}
+
+	server := newTestServer(t)
+	server.nosftp.Store(true)
+	manager := New(time.Minute, time.Minute)
+	defer manager.Close()
+
+	src := t.TempDir()
+	writeTree(t, src, map[string]string{
+		"a.txt":          "a",
+		"b.log":          "b",
+		"sub/c.txt":      "c",
+		"sub/deep/d.txt": "d",
+		"tmp/e.txt":      "e",
+		"logs/f.log":     "f",
+	})
+
+	mtime := time.Now().Add(-time.Hour).Truncate(time.Second)
+	if err := os.Chtimes(filepath.Join(src, "sub", "c.txt"), mtime, mtime); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx := context.Background()
+	config := server.clientConfig()
+	remote := filepath.Join(t.TempDir(), "remote")
+	options := TransferOptions{
+		PreservePermissions: true,
+		PreserveTimes:       true,
+		Include:             []string{"*.txt"},
+		Exclude:             []string{"tmp"},
+		Verify:              true,
+	}
+
+	if err := manager.Upload(ctx, config, src, remote, options); !errors.Is(err, ErrSFTPUnavailable) {
+		t.Fatalf("expected sftp to be unavailable, got %v", err)
+	}
+
+	options.SCPFallback = true
+	if err := manager.Upload(ctx, config, src, remote, options); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := map[string]string{
+		"a.txt":          "a",
+		"sub/c.txt":      "c",
+		"sub/deep/d.txt": "d",
+	}
+	assertTree(t, remote, expected)
+
+	// Directories without included files are not created
+	if _, err := os.Stat(filepath.Join(remote, "logs")); !os.IsNotExist(err) {
+		t.Fatalf("expected logs not to be created, got: %v", err)
+	}
+
+	info, err := os.Stat(filepath.Join(remote, "sub", "c.txt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Mode().Perm() != 0640 || !info.ModTime().Equal(mtime) {
+		t.Fatalf("expected preserved attributes, got %s %s", info.Mode(), info.ModTime())
+	}
+
+	local := filepath.Join(t.TempDir(), "local")
+	options.Exclude = []string{"deep"}
+	if err = manager.Download(ctx, config, remote, local, options); err != nil {
+		t.Fatal(err)
+	}
+	delete(expected, "sub/deep/d.txt")
+	assertTree(t, local, expected)
+
+	// Single files are copied to the exact destination path
+	single := filepath.Join(t.TempDir(), "renamed.txt")
+	if err = manager.Download(ctx, config, filepath.Join(remote, "a.txt"), single, options); err != nil {
+		t.Fatal(err)
+	}
+	assertFile(t, single, []byte("a"))
+
+	if err = manager.Download(ctx, config, filepath.Join(remote, "missing"), single, options); err == nil {
+		t.Fatal("expected download of a missing file to fail")
+	}
+}
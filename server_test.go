@@ -0,0 +1,307 @@
+package sshmgr
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"encoding/binary"
+	"io"
+	"net"
+	"os/exec"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"testing"
+
+	"github.com/pkg/sftp"
+	"golang.org/x/crypto/ssh"
+)
+
+// testServer is an in-process ssh server accepting the password "secret"
+// and handling exec and sftp sessions, direct-tcpip channels and tcpip-forward requests
+type testServer struct {
+	t           *testing.T
+	config      *ssh.ServerConfig
+	addr        string
+	sftps       int64
+	nosftp      atomic.Bool
+	nokeepalive atomic.Bool
+	mtx         sync.Mutex
+	sftpChans   []ssh.Channel
+
+	// sftpHandler serves sftp sessions in place of the sftp server when set
+	sftpHandler func(rw io.ReadWriter)
+}
+
+func newTestServer(t *testing.T) (s *testServer) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	signer, err := ssh.NewSignerFromKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s = &testServer{t: t}
+	s.config = &ssh.ServerConfig{
+		PasswordCallback: func(_ ssh.ConnMetadata, password []byte) (*ssh.Permissions, error) {
+			if string(password) != "secret" {
+				return nil, errProxyAuth
+			}
+			return nil, nil
+		},
+	}
+	s.config.AddHostKey(signer)
+	s.addr = proxyServer(t, s.serve)
+	return s
+}
+
+// clientConfig returns a client config for the server
+func (s *testServer) clientConfig() (config ClientConfig) {
+	return ClientConfig{NetAddr: s.addr, User: "root", Password: "secret", IgnoreHostKey: true}
+}
+
+func (s *testServer) serve(conn net.Conn) {
+	defer conn.Close()
+
+	sc, chans, reqs, err := ssh.NewServerConn(conn, s.config)
+	if err != nil {
+		return
+	}
+	defer sc.Close()
+
+	go s.globalRequests(sc, reqs)
+	for nc := range chans {
+		switch nc.ChannelType() {
+		case "session":
+			go s.session(nc)
+		case "direct-tcpip":
+			go s.directTCPIP(nc)
+		case "direct-streamlocal@openssh.com":
+			go s.directStreamLocal(nc)
+		default:
+			nc.Reject(ssh.UnknownChannelType, "unsupported channel type")
+		}
+	}
+}
+
+// session handles exec requests running the command with sh
+// and the sftp subsystem
+func (s *testServer) session(nc ssh.NewChannel) {
+	ch, reqs, err := nc.Accept()
+	if err != nil {
+		return
+	}
+	defer ch.Close()
+
+	for req := range reqs {
+		switch req.Type {
+		case "env":
+			req.Reply(true, nil)
+
+		case "exec":
+			command, _, ok := parseString(req.Payload)
+			req.Reply(ok, nil)
+			if !ok {
+				continue
+			}
+
+			// Stdin is copied without waiting for its end, so commands
+			// exiting before reading their input complete like with sshd
+			cmd := exec.Command("sh", "-c", command)
+			cmd.Stdout, cmd.Stderr = ch, ch.Stderr()
+			stdin, err := cmd.StdinPipe()
+			if err != nil {
+				return
+			}
+			go func() {
+				io.Copy(stdin, ch)
+				stdin.Close()
+			}()
+
+			status := uint32(0)
+			if err := cmd.Run(); err != nil {
+				status = 255
+				if exitErr, ok := err.(*exec.ExitError); ok {
+					status = uint32(exitErr.ExitCode())
+				}
+			}
+			ch.SendRequest("exit-status", false, binary.BigEndian.AppendUint32(nil, status))
+			return
+
+		case "subsystem":
+			name, _, ok := parseString(req.Payload)
+			if !ok || name != "sftp" || s.nosftp.Load() {
+				req.Reply(false, nil)
+				continue
+			}
+			req.Reply(true, nil)
+			atomic.AddInt64(&s.sftps, 1)
+			s.mtx.Lock()
+			s.sftpChans = append(s.sftpChans, ch)
+			s.mtx.Unlock()
+
+			if s.sftpHandler != nil {
+				s.sftpHandler(ch)
+				return
+			}
+
+			server, err := sftp.NewServer(ch)
+			if err != nil {
+				return
+			}
+			server.Serve()
+			server.Close()
+			return
+
+		default:
+			req.Reply(false, nil)
+		}
+	}
+}
+
+// killSFTP closes the channels of all sftp sessions keeping the connections up
+func (s *testServer) killSFTP() {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	for _, ch := range s.sftpChans {
+		ch.Close()
+	}
+	s.sftpChans = nil
+}
+
+// directTCPIP connects the channel to the requested host and port
+func (s *testServer) directTCPIP(nc ssh.NewChannel) {
+	data := nc.ExtraData()
+	host, rest, ok := parseString(data)
+	if !ok || len(rest) < 4 {
+		nc.Reject(ssh.ConnectionFailed, "invalid request")
+		return
+	}
+	port := binary.BigEndian.Uint32(rest)
+
+	conn, err := net.Dial("tcp", net.JoinHostPort(host, strconv.Itoa(int(port))))
+	if err != nil {
+		nc.Reject(ssh.ConnectionFailed, err.Error())
+		return
+	}
+
+	s.accept(nc, conn)
+}
+
+// accept accepts the channel and copies data between it and conn
+func (s *testServer) accept(nc ssh.NewChannel, conn net.Conn) {
+	ch, reqs, err := nc.Accept()
+	if err != nil {
+		conn.Close()
+		return
+	}
+	go ssh.DiscardRequests(reqs)
+
+	go func() {
+		io.Copy(ch, conn)
+		ch.CloseWrite()
+	}()
+	io.Copy(conn, ch)
+	conn.Close()
+	ch.Close()
+}
+
+// directStreamLocal connects the channel to the requested unix socket
+func (s *testServer) directStreamLocal(nc ssh.NewChannel) {
+	path, _, ok := parseString(nc.ExtraData())
+	if !ok {
+		nc.Reject(ssh.ConnectionFailed, "invalid request")
+		return
+	}
+
+	conn, err := net.Dial("unix", path)
+	if err != nil {
+		nc.Reject(ssh.ConnectionFailed, err.Error())
+		return
+	}
+	s.accept(nc, conn)
+}
+
+// globalRequests handles tcpip-forward requests listening on the loopback
+// and opening a forwarded-tcpip channel for each accepted connection
+func (s *testServer) globalRequests(sc *ssh.ServerConn, reqs <-chan *ssh.Request) {
+	listeners := map[uint32]net.Listener{}
+	defer func() {
+		for _, l := range listeners {
+			l.Close()
+		}
+	}()
+
+	for req := range reqs {
+		// Unanswered keepalives block later global requests like a hung server
+		if req.Type == keepaliveRequest && s.nokeepalive.Load() {
+			continue
+		}
+
+		addr, rest, ok := parseString(req.Payload)
+		if !ok || len(rest) < 4 {
+			req.Reply(false, nil)
+			continue
+		}
+		port := binary.BigEndian.Uint32(rest)
+
+		switch req.Type {
+		case "tcpip-forward":
+			l, err := net.Listen("tcp", net.JoinHostPort("127.0.0.1", strconv.Itoa(int(port))))
+			if err != nil {
+				req.Reply(false, nil)
+				continue
+			}
+			bound := uint32(l.Addr().(*net.TCPAddr).Port)
+			listeners[bound] = l
+			req.Reply(true, binary.BigEndian.AppendUint32(nil, bound))
+			go s.forwardedTCPIP(sc, l, addr, bound)
+
+		case "cancel-tcpip-forward":
+			if l, ok := listeners[port]; ok {
+				l.Close()
+				delete(listeners, port)
+			}
+			req.Reply(true, nil)
+
+		default:
+			req.Reply(false, nil)
+		}
+	}
+}
+
+func (s *testServer) forwardedTCPIP(sc *ssh.ServerConn, l net.Listener, addr string, port uint32) {
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+
+		payload := appendString(nil, addr)
+		payload = binary.BigEndian.AppendUint32(payload, port)
+		origin := conn.RemoteAddr().(*net.TCPAddr)
+		payload = appendString(payload, origin.IP.String())
+		payload = binary.BigEndian.AppendUint32(payload, uint32(origin.Port))
+
+		ch, reqs, err := sc.OpenChannel("forwarded-tcpip", payload)
+		if err != nil {
+			conn.Close()
+			continue
+		}
+		go ssh.DiscardRequests(reqs)
+
+		go func() {
+			go func() {
+				io.Copy(ch, conn)
+				ch.CloseWrite()
+			}()
+			io.Copy(conn, ch)
+			conn.Close()
+			ch.Close()
+		}()
+	}
+}
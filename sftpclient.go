@@ -0,0 +1,260 @@
+package sshmgr
+
+import (
+	"context"
+	"os"
+	"time"
+
+	"github.com/kr/fs"
+	"github.com/pkg/sftp"
+)
+
+// session returns the current sftp session, moving to a pooled session
+// if the connection was replaced by a reconnect or the session was lost
+func (s *SFTPClient) session() (sess *sftpSession, err error) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	if _, done := s.sess.conn.transport(); done == s.sess.done && !s.sess.dead() {
+		return s.sess, nil
+	}
+
+	sess, err = s.sess.conn.sftpSession(context.Background())
+	if err != nil {
+		return nil, err
+	}
+
+	s.sess.release()
+	s.sess = sess
+	return sess, nil
+}
+
+// connection returns the connection the current sftp session was opened on
+func (s *SFTPClient) connection() (conn *Client) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	return s.sess.conn
+}
+
+// retry runs fn with the current sftp session under the manager retry policy
+func (s *SFTPClient) retry(ctx context.Context, op string, fn func(client *sftp.Client) error) (err error) {
+	return s.connection().retry(ctx, op, func() (err error) {
+		return s.do(fn)
+	})
+}
+
+// do runs fn once with the current sftp session, for operations not safe to retry.
+// The session is removed from the pool if fn fails because it was lost
+func (s *SFTPClient) do(fn func(client *sftp.Client) error) (err error) {
+	sess, err := s.session()
+	if err != nil {
+		return err
+	}
+
+	err = fn(sess.Client)
+	sess.failed(err)
+	return err
+}
+
+// Client returns the sftp client of the current session, for operations not wrapped
+// by SFTPClient. It bypasses the session pooling: the returned client is not replaced
+// on reconnects or lost sessions, and must not be used after Close
+func (s *SFTPClient) Client() (client *sftp.Client, err error) {
+	sess, err := s.session()
+	if err != nil {
+		return nil, err
+	}
+	return sess.Client, nil
+}
+
+// Stat returns a FileInfo describing the named file,
+// retried on a dead transport in the resilient client mode
+func (s *SFTPClient) Stat(p string) (fi os.FileInfo, err error) {
+	err = s.retry(context.Background(), "sftp.stat", func(client *sftp.Client) (err error) {
+		fi, err = client.Stat(p)
+		return err
+	})
+	return fi, err
+}
+
+// Lstat returns a FileInfo describing the named file without following links,
+// retried on a dead transport in the resilient client mode
+func (s *SFTPClient) Lstat(p string) (fi os.FileInfo, err error) {
+	err = s.retry(context.Background(), "sftp.lstat", func(client *sftp.Client) (err error) {
+		fi, err = client.Lstat(p)
+		return err
+	})
+	return fi, err
+}
+
+// ReadDir reads the named directory,
+// retried on a dead transport in the resilient client mode
+func (s *SFTPClient) ReadDir(p string) (entries []os.FileInfo, err error) {
+	err = s.retry(context.Background(), "sftp.readdir", func(client *sftp.Client) (err error) {
+		entries, err = client.ReadDir(p)
+		return err
+	})
+	return entries, err
+}
+
+// ReadLink reads the target of a symbolic link,
+// retried on a dead transport in the resilient client mode
+func (s *SFTPClient) ReadLink(p string) (target string, err error) {
+	err = s.retry(context.Background(), "sftp.readlink", func(client *sftp.Client) (err error) {
+		target, err = client.ReadLink(p)
+		return err
+	})
+	return target, err
+}
+
+// Glob returns the names of all files matching pattern,
+// retried on a dead transport in the resilient client mode
+func (s *SFTPClient) Glob(pattern string) (matches []string, err error) {
+	err = s.retry(context.Background(), "sftp.glob", func(client *sftp.Client) (err error) {
+		matches, err = client.Glob(pattern)
+		return err
+	})
+	return matches, err
+}
+
+// Getwd returns the current remote working directory,
+// retried on a dead transport in the resilient client mode
+func (s *SFTPClient) Getwd() (dir string, err error) {
+	err = s.retry(context.Background(), "sftp.getwd", func(client *sftp.Client) (err error) {
+		dir, err = client.Getwd()
+		return err
+	})
+	return dir, err
+}
+
+// StatVFS returns the file system statistics of the file system holding path,
+// retried on a dead transport in the resilient client mode
+func (s *SFTPClient) StatVFS(p string) (stat *sftp.StatVFS, err error) {
+	err = s.retry(context.Background(), "sftp.statvfs", func(client *sftp.Client) (err error) {
+		stat, err = client.StatVFS(p)
+		return err
+	})
+	return stat, err
+}
+
+// Open opens the named file for reading,
+// retried on a dead transport in the resilient client mode
+func (s *SFTPClient) Open(p string) (f *sftp.File, err error) {
+	err = s.retry(context.Background(), "sftp.open", func(client *sftp.Client) (err error) {
+		f, err = client.Open(p)
+		return err
+	})
+	return f, err
+}
+
+// Walk returns a new Walker rooted at root. Directory reads and stats
+// are retried on a dead transport in the resilient client mode
+func (s *SFTPClient) Walk(root string) (walker *fs.Walker) {
+	return fs.WalkFS(root, s)
+}
+
+// Join joins any number of path elements into a single path
+func (s *SFTPClient) Join(elem ...string) (p string) {
+	return sftp.Join(elem...)
+}
+
+// Chmod changes the permissions of the named file,
+// retried on a dead transport in the resilient client mode
+func (s *SFTPClient) Chmod(p string, mode os.FileMode) (err error) {
+	return s.retry(context.Background(), "sftp.chmod", func(client *sftp.Client) error {
+		return client.Chmod(p, mode)
+	})
+}
+
+// Chown changes the user and group owners of the named file,
+// retried on a dead transport in the resilient client mode
+func (s *SFTPClient) Chown(p string, uid, gid int) (err error) {
+	return s.retry(context.Background(), "sftp.chown", func(client *sftp.Client) error {
+		return client.Chown(p, uid, gid)
+	})
+}
+
+// Chtimes changes the access and modification times of the named file,
+// retried on a dead transport in the resilient client mode
+func (s *SFTPClient) Chtimes(p string, atime, mtime time.Time) (err error) {
+	return s.retry(context.Background(), "sftp.chtimes", func(client *sftp.Client) error {
+		return client.Chtimes(p, atime, mtime)
+	})
+}
+
+// Truncate sets the size of the named file,
+// retried on a dead transport in the resilient client mode
+func (s *SFTPClient) Truncate(p string, size int64) (err error) {
+	return s.retry(context.Background(), "sftp.truncate", func(client *sftp.Client) error {
+		return client.Truncate(p, size)
+	})
+}
+
+// MkdirAll creates a directory and any missing parents,
+// retried on a dead transport in the resilient client mode
+func (s *SFTPClient) MkdirAll(p string) (err error) {
+	return s.retry(context.Background(), "sftp.mkdirall", func(client *sftp.Client) error {
+		return client.MkdirAll(p)
+	})
+}
+
+// Create creates or truncates the named file for reading and writing
+func (s *SFTPClient) Create(p string) (f *sftp.File, err error) {
+	err = s.do(func(client *sftp.Client) (err error) {
+		f, err = client.Create(p)
+		return err
+	})
+	return f, err
+}
+
+// OpenFile opens the named file with the given os.OpenFile flags
+func (s *SFTPClient) OpenFile(p string, flags int) (f *sftp.File, err error) {
+	err = s.do(func(client *sftp.Client) (err error) {
+		f, err = client.OpenFile(p, flags)
+		return err
+	})
+	return f, err
+}
+
+// Mkdir creates the named directory
+func (s *SFTPClient) Mkdir(p string) (err error) {
+	return s.do(func(client *sftp.Client) error {
+		return client.Mkdir(p)
+	})
+}
+
+// Symlink creates newname as a symbolic link to oldname
+func (s *SFTPClient) Symlink(oldname, newname string) (err error) {
+	return s.do(func(client *sftp.Client) error {
+		return client.Symlink(oldname, newname)
+	})
+}
+
+// Remove removes the named file or empty directory
+func (s *SFTPClient) Remove(p string) (err error) {
+	return s.do(func(client *sftp.Client) error {
+		return client.Remove(p)
+	})
+}
+
+// RemoveDirectory removes the named empty directory
+func (s *SFTPClient) RemoveDirectory(p string) (err error) {
+	return s.do(func(client *sftp.Client) error {
+		return client.RemoveDirectory(p)
+	})
+}
+
+// Rename renames oldname to newname, failing if newname exists
+func (s *SFTPClient) Rename(oldname, newname string) (err error) {
+	return s.do(func(client *sftp.Client) error {
+		return client.Rename(oldname, newname)
+	})
+}
+
+// PosixRename renames oldname to newname, replacing newname if it exists,
+// with the posix-rename@openssh.com extension
+func (s *SFTPClient) PosixRename(oldname, newname string) (err error) {
+	return s.do(func(client *sftp.Client) error {
+		return client.PosixRename(oldname, newname)
+	})
+}
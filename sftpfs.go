@@ -0,0 +1,302 @@
+package sshmgr
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"io/fs"
+	"path"
+	"sort"
+
+	"github.com/pkg/sftp"
+)
+
+// WritableFile is an open file that can be written to
+type WritableFile interface {
+	fs.File
+	io.Writer
+}
+
+// WritableFS is a file system that can be modified
+type WritableFS interface {
+	fs.FS
+
+	// Create creates or truncates the named file for writing
+	Create(name string) (WritableFile, error)
+
+	// WriteFile atomically replaces the named file with data
+	WriteFile(name string, data []byte, perm fs.FileMode) error
+
+	// Mkdir creates the named directory
+	Mkdir(name string, perm fs.FileMode) error
+
+	// MkdirAll creates the named directory along with any missing parents
+	MkdirAll(name string) error
+
+	// Remove removes the named file or empty directory
+	Remove(name string) error
+
+	// Rename moves oldname to newname, replacing newname if it exists
+	Rename(oldname, newname string) error
+}
+
+// SFTPFS exposes the remote file system under a root directory as a io/fs.FS,
+// implementing fs.ReadDirFS, fs.StatFS, fs.ReadFileFS and WritableFS.
+// Names are slash separated and relative to the root as required by io/fs.
+// Reads are retried on a dead transport in the resilient client mode
+type SFTPFS struct {
+	s    *SFTPClient
+	root string
+}
+
+var (
+	_ fs.ReadDirFS  = (*SFTPFS)(nil)
+	_ fs.StatFS     = (*SFTPFS)(nil)
+	_ fs.ReadFileFS = (*SFTPFS)(nil)
+	_ WritableFS    = (*SFTPFS)(nil)
+)
+
+// FS returns a file system rooted at the remote directory root,
+// relative roots are resolved from the remote user home directory
+func (s *SFTPClient) FS(root string) (fsys *SFTPFS) {
+	if root == "" {
+		root = "."
+	}
+	return &SFTPFS{s: s, root: root}
+}
+
+// path returns the remote path of name after validating it
+func (f *SFTPFS) path(op, name string) (p string, err error) {
+	if !fs.ValidPath(name) {
+		return "", &fs.PathError{Op: op, Path: name, Err: fs.ErrInvalid}
+	}
+	return path.Join(f.root, name), nil
+}
+
+// pathError wraps err with the file system name instead of the remote path
+func pathError(op, name string, err error) error {
+	if err == nil {
+		return nil
+	}
+	return &fs.PathError{Op: op, Path: name, Err: err}
+}
+
+// Open opens the named file or directory for reading
+func (f *SFTPFS) Open(name string) (file fs.File, err error) {
+	p, err := f.path("open", name)
+	if err != nil {
+		return nil, err
+	}
+
+	info, err := f.s.Stat(p)
+	if err != nil {
+		return nil, pathError("open", name, err)
+	}
+
+	if info.IsDir() {
+		return &sftpDir{fsys: f, name: name, info: fileInfo{info, path.Base(name)}}, nil
+	}
+
+	sf, err := f.s.Open(p)
+	if err != nil {
+		return nil, pathError("open", name, err)
+	}
+	return &sftpFile{File: sf, name: name}, nil
+}
+
+// Stat returns a FileInfo describing the named file, following symbolic links
+func (f *SFTPFS) Stat(name string) (info fs.FileInfo, err error) {
+	p, err := f.path("stat", name)
+	if err != nil {
+		return nil, err
+	}
+
+	if info, err = f.s.Stat(p); err != nil {
+		return nil, pathError("stat", name, err)
+	}
+	return fileInfo{info, path.Base(name)}, nil
+}
+
+// ReadDir reads the named directory and returns its entries sorted by name
+func (f *SFTPFS) ReadDir(name string) (entries []fs.DirEntry, err error) {
+	p, err := f.path("readdir", name)
+	if err != nil {
+		return nil, err
+	}
+
+	infos, err := f.s.ReadDir(p)
+	if err != nil {
+		return nil, pathError("readdir", name, err)
+	}
+
+	entries = make([]fs.DirEntry, len(infos))
+	for i, info := range infos {
+		entries[i] = fs.FileInfoToDirEntry(info)
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Name() < entries[j].Name() })
+	return entries, nil
+}
+
+// ReadFile reads the named file and returns its contents
+func (f *SFTPFS) ReadFile(name string) (data []byte, err error) {
+	p, err := f.path("readfile", name)
+	if err != nil {
+		return nil, err
+	}
+
+	err = f.s.retry(context.Background(), "sftp.readfile", func(client *sftp.Client) (err error) {
+		file, err := client.Open(p)
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+
+		var buf bytes.Buffer
+		if _, err = file.WriteTo(&buf); err != nil {
+			return err
+		}
+		data = buf.Bytes()
+		return nil
+	})
+	return data, pathError("readfile", name, err)
+}
+
+// Create creates or truncates the named file for writing
+func (f *SFTPFS) Create(name string) (file WritableFile, err error) {
+	p, err := f.path("create", name)
+	if err != nil {
+		return nil, err
+	}
+
+	err = (&remoteFS{f.s}).do(func(client *sftp.Client) (err error) {
+		sf, err := client.Create(p)
+		if err == nil {
+			file = &sftpFile{File: sf, name: name}
+		}
+		return err
+	})
+	return file, pathError("create", name, err)
+}
+
+// WriteFile atomically replaces the named file with data, see SFTPClient.WriteFile
+func (f *SFTPFS) WriteFile(name string, data []byte, perm fs.FileMode) (err error) {
+	p, err := f.path("writefile", name)
+	if err != nil {
+		return err
+	}
+
+	err = f.s.WriteFile(context.Background(), p, data, WriteFileOptions{Mode: perm})
+	return pathError("writefile", name, err)
+}
+
+// Mkdir creates the named directory
+func (f *SFTPFS) Mkdir(name string, perm fs.FileMode) (err error) {
+	p, err := f.path("mkdir", name)
+	if err != nil {
+		return err
+	}
+
+	err = (&remoteFS{f.s}).do(func(client *sftp.Client) (err error) {
+		if err = client.Mkdir(p); err != nil {
+			return err
+		}
+		return client.Chmod(p, perm)
+	})
+	return pathError("mkdir", name, err)
+}
+
+// MkdirAll creates the named directory along with any missing parents
+func (f *SFTPFS) MkdirAll(name string) (err error) {
+	p, err := f.path("mkdir", name)
+	if err != nil {
+		return err
+	}
+	return pathError("mkdir", name, (&remoteFS{f.s}).MkdirAll(p))
+}
+
+// Remove removes the named file or empty directory
+func (f *SFTPFS) Remove(name string) (err error) {
+	p, err := f.path("remove", name)
+	if err != nil {
+		return err
+	}
+	return pathError("remove", name, (&remoteFS{f.s}).Remove(p))
+}
+
+// Rename moves oldname to newname, replacing newname if it exists.
+// The replacement is atomic if the server supports posix-rename@openssh.com
+func (f *SFTPFS) Rename(oldname, newname string) (err error) {
+	oldpath, err := f.path("rename", oldname)
+	if err != nil {
+		return err
+	}
+
+	newpath, err := f.path("rename", newname)
+	if err != nil {
+		return err
+	}
+
+	err = (&remoteFS{f.s}).do(func(client *sftp.Client) error {
+		return rename(client, oldpath, newpath)
+	})
+	return pathError("rename", oldname, err)
+}
+
+// fileInfo reports the file system name instead of the remote base name
+type fileInfo struct {
+	fs.FileInfo
+	name string
+}
+
+func (i fileInfo) Name() string { return i.name }
+
+// sftpFile is an open remote file
+type sftpFile struct {
+	*sftp.File
+	name string
+}
+
+func (f *sftpFile) Stat() (info fs.FileInfo, err error) {
+	if info, err = f.File.Stat(); err != nil {
+		return nil, pathError("stat", f.name, err)
+	}
+	return fileInfo{info, path.Base(f.name)}, nil
+}
+
+// sftpDir is an open remote directory, read on the first ReadDir call
+type sftpDir struct {
+	fsys    *SFTPFS
+	name    string
+	info    fs.FileInfo
+	entries []fs.DirEntry
+	read    bool
+}
+
+func (d *sftpDir) Stat() (info fs.FileInfo, err error) { return d.info, nil }
+func (d *sftpDir) Close() (err error)                  { return nil }
+
+func (d *sftpDir) Read(p []byte) (n int, err error) {
+	return 0, &fs.PathError{Op: "read", Path: d.name, Err: errors.New("is a directory")}
+}
+
+// ReadDir returns the next n entries, or all remaining entries if n <= 0
+func (d *sftpDir) ReadDir(n int) (entries []fs.DirEntry, err error) {
+	if !d.read {
+		if d.entries, err = d.fsys.ReadDir(d.name); err != nil {
+			return nil, err
+		}
+		d.read = true
+	}
+
+	if n > 0 && len(d.entries) == 0 {
+		return nil, io.EOF
+	}
+
+	if n <= 0 || n > len(d.entries) {
+		n = len(d.entries)
+	}
+
+	entries, d.entries = d.entries[:n:n], d.entries[n:]
+	return entries, nil
+}
@@ -0,0 +1,65 @@
+package sshmgr
+
+import (
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"testing"
+	"testing/fstest"
+	"time"
+)
+
+func TestSFTPFS(t *testing.T) {
+	server := newTestServer(t)
+	manager := New(time.Minute, time.Minute)
+	defer manager.Close()
+
+	session, err := manager.SFTPClient(server.clientConfig())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer session.Close()
+
+	root := t.TempDir()
+	writeTree(t, root, map[string]string{
+		"index.html":        "<html></html>",
+		"static/app.js":     "console.log(1)",
+		"static/css/a.css":  "body {}",
+		"templates/base.tm": "{{.}}",
+	})
+
+	fsys := session.FS(root)
+	if err = fstest.TestFS(fsys, "index.html", "static/app.js", "static/css/a.css", "templates/base.tm"); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err = fsys.Open("../escape"); !errors.Is(err, fs.ErrInvalid) {
+		t.Fatalf("expected invalid path error, got %v", err)
+	}
+
+	if _, err = fsys.Stat("missing"); !errors.Is(err, fs.ErrNotExist) {
+		t.Fatalf("expected not exist error, got %v", err)
+	}
+
+	if err = fsys.MkdirAll("conf/d"); err != nil {
+		t.Fatal(err)
+	}
+
+	if err = fsys.WriteFile("conf/d/app.conf", []byte("a=1"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	if err = fsys.Rename("conf/d/app.conf", "conf/app.conf"); err != nil {
+		t.Fatal(err)
+	}
+	assertFile(t, filepath.Join(root, "conf", "app.conf"), []byte("a=1"))
+
+	if err = fsys.Remove("conf/d"); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err = os.Stat(filepath.Join(root, "conf", "d")); !errors.Is(err, fs.ErrNotExist) {
+		t.Fatalf("expected removed directory, got %v", err)
+	}
+}
@@ -0,0 +1,269 @@
+package sshmgr
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log/slog"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/pkg/sftp"
+	"golang.org/x/crypto/ssh"
+)
+
+// ErrSFTPUnavailable is returned opening sftp sessions on hosts without a sftp subsystem
+var ErrSFTPUnavailable = errors.New("sftp subsystem unavailable")
+
+// sftpSession is a sftp subsystem session pooled on the connection it was opened on.
+// It holds a session slot on the connection while open, and is shared by
+// SFTPClient handles each holding a reference on it and on the connection
+type sftpSession struct {
+	*sftp.Client
+	conn   *Client
+	done   chan struct{}
+	w      *onceCloser
+	lost   atomic.Bool
+	refs   int
+	atime  int64
+	pooled bool
+}
+
+// sftpSession returns a sftp session with a reference held on it and on its connection.
+// Idle pooled sessions are preferred, then opening a new session if this connection
+// has a free slot, then sharing the least used session and last opening a session
+// on a sibling connection
+func (c *Client) sftpSession(ctx context.Context) (s *sftpSession, err error) {
+	if s = c.pooledSFTP(false); s != nil {
+		return s, nil
+	}
+
+	if c.reserveSession() {
+		c.incr()
+		return c.newSFTP(ctx)
+	}
+
+	if s = c.pooledSFTP(true); s != nil {
+		return s, nil
+	}
+
+	conn, err := c.mgr.sibling(ctx, c)
+	if err != nil {
+		return nil, err
+	}
+	return conn.newSFTP(ctx)
+}
+
+// pooledSFTP returns the least used pooled session on the current transport
+// with a reference held, if idle or if share is true
+func (c *Client) pooledSFTP(share bool) (s *sftpSession) {
+	_, done := c.transport()
+	var stale []*sftpSession
+
+	c.smtx.Lock()
+	pool := c.sftps[:0]
+	for _, ps := range c.sftps {
+		if ps.done != done || ps.dead() {
+			// Opened on a transport replaced by a reconnect or ended by the server
+			ps.pooled = false
+			if ps.refs == 0 {
+				stale = append(stale, ps)
+			}
+			continue
+		}
+
+		pool = append(pool, ps)
+		if s == nil || ps.refs < s.refs {
+			s = ps
+		}
+	}
+	c.sftps = pool
+
+	if s != nil && (share || s.refs == 0) {
+		s.refs++
+		c.incr()
+	} else {
+		s = nil
+	}
+	c.smtx.Unlock()
+
+	for _, ps := range stale {
+		ps.close()
+	}
+	return s
+}
+
+// newSFTP opens a sftp session on the connection using an already reserved
+// session slot and reference, and adds it to the pool
+func (c *Client) newSFTP(ctx context.Context) (s *sftpSession, err error) {
+	_, span := c.tracer.Start(ctx, "sshmgr.sftp.open", c.attrs...)
+	sc, done := c.transport()
+	client, w, err := newSFTPClient(sc)
+	endSpan(span, err)
+
+	if err != nil {
+		c.log.Error("sftp session failed", slog.Any("error", err))
+		c.releaseSession()
+		return nil, err
+	}
+
+	s = &sftpSession{Client: client, conn: c, done: done, w: w, refs: 1, pooled: true}
+	c.smtx.Lock()
+	c.sftps = append(c.sftps, s)
+	c.smtx.Unlock()
+	return s, nil
+}
+
+// newSFTPClient is like sftp.NewClient but closes the ssh session if the
+// sftp subsystem fails, reporting rejected subsystem requests as ErrSFTPUnavailable
+func newSFTPClient(conn *ssh.Client) (client *sftp.Client, w *onceCloser, err error) {
+	s, err := conn.NewSession()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	ok, err := s.SendRequest("subsystem", true, ssh.Marshal(struct{ Name string }{"sftp"}))
+	if err == nil && !ok {
+		err = ErrSFTPUnavailable
+	}
+	if err != nil {
+		s.Close()
+		return nil, nil, err
+	}
+
+	stdin, err := s.StdinPipe()
+	if err != nil {
+		s.Close()
+		return nil, nil, err
+	}
+
+	r, err := s.StdoutPipe()
+	if err != nil {
+		s.Close()
+		return nil, nil, err
+	}
+
+	// The sftp client closes its writer both from its receive loop when the
+	// session ends and from Close, which race on the channel if not serialized
+	w = &onceCloser{WriteCloser: stdin}
+	if client, err = sftp.NewClientPipe(r, w); err != nil {
+		s.Close()
+		return nil, nil, err
+	}
+	return client, w, nil
+}
+
+// onceCloser is a io.WriteCloser closed only once
+type onceCloser struct {
+	io.WriteCloser
+	once   sync.Once
+	closed atomic.Bool
+	err    error
+}
+
+func (c *onceCloser) Close() (err error) {
+	c.once.Do(func() {
+		c.closed.Store(true)
+		c.err = c.WriteCloser.Close()
+	})
+	return c.err
+}
+
+// dead reports whether the session can no longer be used, because an operation
+// failed with the session lost or because the sftp client stopped receiving
+func (s *sftpSession) dead() (dead bool) {
+	return s.lost.Load() || s.w.closed.Load()
+}
+
+// failed checks the error of an operation on the session, removing the session
+// from the pool if it was lost while the connection is still up. The session
+// is closed once its last reference is released
+func (s *sftpSession) failed(err error) {
+	if err == nil || (!sessionLost(err) && !s.w.closed.Load()) {
+		return
+	}
+
+	c := s.conn
+	c.smtx.Lock()
+	s.lost.Store(true)
+	pooled := s.pooled
+	if pooled {
+		s.pooled = false
+		for i := range c.sftps {
+			if c.sftps[i] == s {
+				c.sftps = append(c.sftps[:i:i], c.sftps[i+1:]...)
+				break
+			}
+		}
+	}
+	c.smtx.Unlock()
+
+	if pooled {
+		c.log.Warn("sftp session lost, removing from pool", slog.Any("error", err))
+	}
+}
+
+// sessionLost reports whether err was caused by the sftp session channel ending
+func sessionLost(err error) (lost bool) {
+	return errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) ||
+		errors.Is(err, sftp.ErrSshFxConnectionLost) || errors.Is(err, sftp.ErrSshFxNoConnection) ||
+		errors.Is(err, net.ErrClosed) || errors.Is(err, io.ErrClosedPipe)
+}
+
+// release drops a reference on the session and its connection. Sessions no
+// longer pooled are closed when the last reference is released
+func (s *sftpSession) release() {
+	c := s.conn
+
+	c.smtx.Lock()
+	s.refs--
+	s.atime = time.Now().Unix()
+	closing := s.refs == 0 && !s.pooled
+	c.smtx.Unlock()
+
+	if closing {
+		s.close()
+	}
+	c.Close()
+}
+
+// close the sftp session and release its session slot
+func (s *sftpSession) close() {
+	s.Client.Close()
+	atomic.AddInt32(&s.conn.sessions, -1)
+}
+
+// expireSFTP closes pooled sessions idle for ttl seconds or more.
+// With a negative ttl a single idle session is closed
+func (c *Client) expireSFTP(ttl int64) (n int) {
+	now := time.Now().Unix()
+	var expired []*sftpSession
+
+	c.smtx.Lock()
+	pool := c.sftps[:0]
+	for _, s := range c.sftps {
+		idle := s.refs == 0 && (ttl < 0 && len(expired) == 0 || ttl >= 0 && now-s.atime >= ttl)
+		if idle {
+			s.pooled = false
+			expired = append(expired, s)
+			continue
+		}
+		pool = append(pool, s)
+	}
+	c.sftps = pool
+	c.smtx.Unlock()
+
+	for _, s := range expired {
+		s.close()
+	}
+	return len(expired)
+}
+
+// pooledSFTPCount returns the number of pooled sftp sessions
+func (c *Client) pooledSFTPCount() (n int) {
+	c.smtx.Lock()
+	defer c.smtx.Unlock()
+	return len(c.sftps)
+}
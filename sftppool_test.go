@@ -0,0 +1,152 @@
+package sshmgr
+
+import (
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestSFTPSessionPool(t *testing.T) {
+	server := newTestServer(t)
+	manager := New(time.Minute, time.Minute)
+	defer manager.Close()
+
+	for i := 0; i < 3; i++ {
+		session, err := manager.SFTPClient(server.clientConfig())
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if _, err = session.Getwd(); err != nil {
+			t.Fatal(err)
+		}
+
+		if err = session.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if n := atomic.LoadInt64(&server.sftps); n != 1 {
+		t.Fatalf("expected a single pooled sftp session, got %d opened", n)
+	}
+
+	// Concurrent holders get idle sessions first, then a new session while slots are free
+	a, err := manager.SFTPClient(server.clientConfig())
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := manager.SFTPClient(server.clientConfig())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if a.sess == b.sess {
+		t.Fatal("expected a new session while the pooled session is in use")
+	}
+	a.Close()
+	b.Close()
+
+	stats := manager.Stats()
+	if stats.SFTPSessions != 2 || stats.Sessions != 2 || stats.InUse != 0 {
+		t.Fatalf("unexpected stats: %+v", stats)
+	}
+
+	// Idle sessions are expired by the manager gc
+	manager.mtx.RLock()
+	client := manager.clients[server.clientConfig().id()][0]
+	manager.mtx.RUnlock()
+
+	if n := client.expireSFTP(0); n != 2 {
+		t.Fatalf("expected 2 idle sessions to expire, got %d", n)
+	}
+
+	if stats = manager.Stats(); stats.SFTPSessions != 0 || stats.Sessions != 0 {
+		t.Fatalf("unexpected stats: %+v", stats)
+	}
+}
+
+func TestSFTPSessionSlotEviction(t *testing.T) {
+	server := newTestServer(t)
+	manager := New(time.Minute, time.Minute, WithMaxSessions(1))
+	defer manager.Close()
+
+	session, err := manager.SFTPClient(server.clientConfig())
+	if err != nil {
+		t.Fatal(err)
+	}
+	session.Close()
+
+	client, err := manager.SSHClient(server.clientConfig())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	if _, err = client.CombinedOutput("true", nil); err != nil {
+		t.Fatal(err)
+	}
+
+	if stats := manager.Stats(); stats.Clients != 1 || stats.SFTPSessions != 0 {
+		t.Fatalf("expected the idle sftp session to free its slot, got: %+v", stats)
+	}
+}
+
+func TestSFTPSessionLost(t *testing.T) {
+	server := newTestServer(t)
+	manager := New(time.Minute, time.Minute)
+	defer manager.Close()
+
+	session, err := manager.SFTPClient(server.clientConfig())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err = session.Getwd(); err != nil {
+		t.Fatal(err)
+	}
+	lost := session.sess
+
+	// The sftp channel ends while the connection stays up
+	server.killSFTP()
+	if err = session.Mkdir(filepath.Join(t.TempDir(), "sub")); err == nil {
+		t.Fatal("expected mkdir on a lost session to fail")
+	}
+
+	if stats := manager.Stats(); stats.SFTPSessions != 0 {
+		t.Fatalf("expected the lost session to be removed from the pool, got: %+v", stats)
+	}
+
+	session.Close()
+	if stats := manager.Stats(); stats.Sessions != 0 || stats.Clients != 1 {
+		t.Fatalf("expected the lost session to be closed on release, got: %+v", stats)
+	}
+
+	// New handles get a new session on the same connection
+	session, err = manager.SFTPClient(server.clientConfig())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer session.Close()
+
+	if session.sess == lost {
+		t.Fatal("expected the lost session not to be handed out again")
+	}
+	if _, err = session.Getwd(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Handles move to a new session once theirs is lost
+	server.killSFTP()
+	session.Mkdir(filepath.Join(t.TempDir(), "sub"))
+	if _, err = session.Getwd(); err != nil {
+		t.Fatal(err)
+	}
+
+	if n := atomic.LoadInt64(&server.sftps); n != 3 {
+		t.Fatalf("expected 3 sftp sessions opened, got %d", n)
+	}
+	if stats := manager.Stats(); stats.Clients != 1 || stats.SFTPSessions != 1 || stats.Sessions != 1 {
+		t.Fatalf("unexpected stats: %+v", stats)
+	}
+}
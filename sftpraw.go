@@ -0,0 +1,244 @@
+package sshmgr
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+)
+
+// sftp packet types, flags and status codes used by extended requests
+const (
+	sshFxpInit          = 1
+	sshFxpVersion       = 2
+	sshFxpOpen          = 3
+	sshFxpClose         = 4
+	sshFxpWrite         = 6
+	sshFxpFsetstat      = 10
+	sshFxpStatus        = 101
+	sshFxpHandle        = 102
+	sshFxpExtended      = 200
+	sshFxpExtendedReply = 201
+
+	sshFxfRead  = 1
+	sshFxfWrite = 2
+	sshFxfCreat = 8
+	sshFxfExcl  = 0x20
+
+	sshFileXferAttrUIDGID      = 2
+	sshFileXferAttrPermissions = 4
+
+	sshFxOk               = 0
+	sshFxNoSuchFile       = 2
+	sshFxPermissionDenied = 3
+
+	// maxRawSFTPPacket bounds the size of packets read from the server
+	maxRawSFTPPacket = 256 << 10
+)
+
+// rawSFTP runs fn with a sftp connection on a dedicated sftp session, as the
+// sftp client package does not support extended requests
+func (c *Client) rawSFTP(ctx context.Context, fn func(conn *rawSFTPConn) error) (err error) {
+	s, err := c.newSession(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer s.Close()
+
+	w, err := s.StdinPipe()
+	if err != nil {
+		return err
+	}
+
+	r, err := s.StdoutPipe()
+	if err != nil {
+		return err
+	}
+
+	ok, err := s.SendRequest("subsystem", true, appendString(nil, "sftp"))
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return ErrSFTPUnavailable
+	}
+
+	stop := context.AfterFunc(ctx, func() { s.Close() })
+	defer stop()
+
+	conn := &rawSFTPConn{r: r, w: w}
+	if err = conn.init(); err == nil {
+		err = fn(conn)
+	}
+
+	if !stop() {
+		return ctx.Err()
+	}
+	return err
+}
+
+// rawSFTPConn speaks the sftp protocol version 3 to issue extended requests
+type rawSFTPConn struct {
+	r    io.Reader
+	w    io.Writer
+	id   uint32
+	exts map[string]string
+}
+
+func (c *rawSFTPConn) send(typ byte, payload []byte) (err error) {
+	packet := binary.BigEndian.AppendUint32(nil, uint32(len(payload)+1))
+	packet = append(packet, typ)
+	_, err = c.w.Write(append(packet, payload...))
+	return err
+}
+
+func (c *rawSFTPConn) recv() (typ byte, payload []byte, err error) {
+	var header [5]byte
+	if _, err = io.ReadFull(c.r, header[:]); err != nil {
+		return 0, nil, noEOF(err)
+	}
+
+	size := binary.BigEndian.Uint32(header[:4])
+	if size < 1 || size > maxRawSFTPPacket {
+		return 0, nil, fmt.Errorf("sftp: invalid packet size %d", size)
+	}
+
+	payload = make([]byte, size-1)
+	if _, err = io.ReadFull(c.r, payload); err != nil {
+		return 0, nil, noEOF(err)
+	}
+	return header[4], payload, nil
+}
+
+// init negotiates the protocol version and records the extensions advertised by the server
+func (c *rawSFTPConn) init() (err error) {
+	if err = c.send(sshFxpInit, binary.BigEndian.AppendUint32(nil, 3)); err != nil {
+		return err
+	}
+
+	typ, payload, err := c.recv()
+	if err != nil {
+		return err
+	}
+	if typ != sshFxpVersion || len(payload) < 4 {
+		return fmt.Errorf("sftp: unexpected packet type %d", typ)
+	}
+
+	c.exts = make(map[string]string)
+	for rest := payload[4:]; len(rest) > 0; {
+		name, data, ok := parseString(rest)
+		if !ok {
+			break
+		}
+		var version string
+		if version, rest, ok = parseString(data); !ok {
+			break
+		}
+		c.exts[name] = version
+	}
+	return nil
+}
+
+// supports reports whether the server advertised the extension name
+func (c *rawSFTPConn) supports(name string) (ok bool) {
+	_, ok = c.exts[name]
+	return ok
+}
+
+// request sends a request of type typ with the next request id followed by
+// payload, and returns the reply without its id
+func (c *rawSFTPConn) request(typ byte, payload []byte) (rtyp byte, reply []byte, err error) {
+	c.id++
+	req := binary.BigEndian.AppendUint32(nil, c.id)
+	if err = c.send(typ, append(req, payload...)); err != nil {
+		return 0, nil, err
+	}
+
+	if rtyp, reply, err = c.recv(); err != nil {
+		return 0, nil, err
+	}
+	if len(reply) < 4 || binary.BigEndian.Uint32(reply) != c.id {
+		return 0, nil, errors.New("sftp: unexpected reply id")
+	}
+	return rtyp, reply[4:], nil
+}
+
+// status returns the error of a status reply to the operation op on name
+func (c *rawSFTPConn) status(op, name string, reply []byte) (err error) {
+	if len(reply) < 4 {
+		return errors.New("sftp: short status reply")
+	}
+	code := binary.BigEndian.Uint32(reply)
+	msg, _, _ := parseString(reply[4:])
+
+	switch code {
+	case sshFxOk:
+		return nil
+	case sshFxNoSuchFile:
+		return &os.PathError{Op: op, Path: name, Err: os.ErrNotExist}
+	case sshFxPermissionDenied:
+		return &os.PathError{Op: op, Path: name, Err: os.ErrPermission}
+	}
+	return fmt.Errorf("%s %s: %s (status %d)", op, name, msg, code)
+}
+
+// call sends a request of type typ for the operation op on name, expecting a status reply
+func (c *rawSFTPConn) call(op, name string, typ byte, payload []byte) (err error) {
+	rtyp, reply, err := c.request(typ, payload)
+	if err != nil {
+		return err
+	}
+	if rtyp != sshFxpStatus {
+		return fmt.Errorf("sftp: unexpected packet type %d", rtyp)
+	}
+	return c.status(op, name, reply)
+}
+
+// open opens the file or directory name with the sftp open flags pflags and returns its handle
+func (c *rawSFTPConn) open(name string, pflags uint32) (handle string, err error) {
+	req := appendString(nil, name)
+	req = binary.BigEndian.AppendUint32(req, pflags)
+	req = binary.BigEndian.AppendUint32(req, 0) // no attributes
+	typ, reply, err := c.request(sshFxpOpen, req)
+	if err != nil {
+		return "", err
+	}
+
+	switch typ {
+	case sshFxpStatus:
+		if err = c.status("open", name, reply); err == nil {
+			err = errors.New("sftp: open without handle")
+		}
+		return "", err
+	case sshFxpHandle:
+		if handle, _, ok := parseString(reply); ok {
+			return handle, nil
+		}
+		return "", errors.New("sftp: short handle reply")
+	default:
+		return "", fmt.Errorf("sftp: unexpected packet type %d", typ)
+	}
+}
+
+// close closes the handle of the file or directory name
+func (c *rawSFTPConn) close(name, handle string) (err error) {
+	return c.call("close", name, sshFxpClose, appendString(nil, handle))
+}
+
+func appendString(b []byte, s string) []byte {
+	b = binary.BigEndian.AppendUint32(b, uint32(len(s)))
+	return append(b, s...)
+}
+
+func parseString(b []byte) (s string, rest []byte, ok bool) {
+	if len(b) < 4 {
+		return "", nil, false
+	}
+	size := binary.BigEndian.Uint32(b)
+	if uint64(len(b)-4) < uint64(size) {
+		return "", nil, false
+	}
+	return string(b[4 : 4+size]), b[4+size:], true
+}
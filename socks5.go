@@ -0,0 +1,292 @@
+package sshmgr
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"strconv"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// SOCKS5 protocol constants from RFC 1928 and RFC 1929
+const (
+	socks5Version      = 0x05
+	socks5AuthVersion  = 0x01
+	socks5NoAuth       = 0x00
+	socks5UserPassAuth = 0x02
+	socks5NoAcceptable = 0xff
+	socks5Connect      = 0x01
+	socks5AddrIPv4     = 0x01
+	socks5AddrDomain   = 0x03
+	socks5AddrIPv6     = 0x04
+
+	socks5Succeeded           = 0x00
+	socks5GeneralFailure      = 0x01
+	socks5NotAllowed          = 0x02
+	socks5HostUnreachable     = 0x04
+	socks5ConnectionRefused   = 0x05
+	socks5CommandNotSupported = 0x07
+	socks5AddrNotSupported    = 0x08
+)
+
+// socks5HandshakeTimeout bounds the SOCKS5 negotiation of accepted connections
+const socks5HandshakeTimeout = 30 * time.Second
+
+// socks5ReplyText returns the description of a SOCKS5 reply code
+func socks5ReplyText(code byte) (text string) {
+	switch code {
+	case 0x00:
+		return "succeeded"
+	case 0x01:
+		return "general SOCKS server failure"
+	case 0x02:
+		return "connection not allowed by ruleset"
+	case 0x03:
+		return "network unreachable"
+	case 0x04:
+		return "host unreachable"
+	case 0x05:
+		return "connection refused"
+	case 0x06:
+		return "TTL expired"
+	case 0x07:
+		return "command not supported"
+	case 0x08:
+		return "address type not supported"
+	}
+	return "unknown reply code"
+}
+
+// SOCKS5Auth authenticates SOCKS5 clients with RFC 1929 username/password
+// authentication, returning true if the credentials are valid
+type SOCKS5Auth func(username, password string) bool
+
+// SOCKS5Proxy is a local SOCKS5 server whose outbound connections
+// are made through a managed client, like ssh -D
+type SOCKS5Proxy struct {
+	*tunnel
+}
+
+// DynamicForward starts a SOCKS5 server on the local laddr connecting to the
+// requested destinations from the remote host through the client. Clients must
+// authenticate if auth is not nil. Only the CONNECT command is supported.
+// The proxy holds a reference on the client until it is closed
+func (c *Client) DynamicForward(laddr string, auth SOCKS5Auth) (proxy *SOCKS5Proxy, err error) {
+	if c.isClosed() {
+		return nil, errClientClosed
+	}
+
+	listener, err := net.Listen("tcp", laddr)
+	if err != nil {
+		return nil, err
+	}
+
+	c.incr()
+	return c.dynamicForward(listener, auth), nil
+}
+
+// dynamicForward starts the SOCKS5 server on listener,
+// taking over a client reference already held by the caller
+func (c *Client) dynamicForward(listener net.Listener, auth SOCKS5Auth) (proxy *SOCKS5Proxy) {
+	log := c.log.With(slog.String("local", listener.Addr().String()))
+	proxy = &SOCKS5Proxy{tunnel: newTunnel(c, listener, log, c.Close)}
+
+	proxy.wg.Add(1)
+	go proxy.serve(func(conn net.Conn) (remote net.Conn, err error) {
+		conn.SetDeadline(time.Now().Add(socks5HandshakeTimeout))
+		addr, err := socks5Handshake(conn, auth)
+		if err != nil {
+			return nil, err
+		}
+
+		if remote, err = c.dialRemote(context.Background(), "tcp", addr); err != nil {
+			socks5Reply(conn, socks5DialFailure(err))
+			return nil, err
+		}
+
+		if err = socks5Reply(conn, socks5Succeeded); err != nil {
+			remote.Close()
+			return nil, err
+		}
+
+		conn.SetDeadline(time.Time{})
+		return remote, nil
+	})
+
+	log.Info("socks5 proxy started")
+	return proxy
+}
+
+// DynamicForward starts a SOCKS5 server on the local laddr connecting to the
+// requested destinations from the remote host of a managed client for config
+func (m *Manager) DynamicForward(config ClientConfig, laddr string, auth SOCKS5Auth) (proxy *SOCKS5Proxy, err error) {
+	listener, err := net.Listen("tcp", laddr)
+	if err != nil {
+		return nil, err
+	}
+
+	client, err := m.SSHClient(config)
+	if err != nil {
+		listener.Close()
+		return nil, err
+	}
+	return client.dynamicForward(listener, auth), nil
+}
+
+// Addr returns the local listening address
+func (p *SOCKS5Proxy) Addr() (addr net.Addr) {
+	return p.listener.Addr()
+}
+
+// Stats returns the proxy connection and byte counters
+func (p *SOCKS5Proxy) Stats() (stats TunnelStats) {
+	return p.stats()
+}
+
+// Close stops the proxy, closing all proxied connections
+// and releasing the client reference
+func (p *SOCKS5Proxy) Close() (err error) {
+	return p.close()
+}
+
+// socks5Handshake negotiates authentication and reads the CONNECT request
+// from a SOCKS5 client, returning the requested destination address
+func socks5Handshake(conn net.Conn, auth SOCKS5Auth) (addr string, err error) {
+	header := make([]byte, 2)
+	if _, err = io.ReadFull(conn, header); err != nil {
+		return "", err
+	}
+
+	if header[0] != socks5Version {
+		return "", fmt.Errorf("socks5: unexpected protocol version %d", header[0])
+	}
+
+	methods := make([]byte, header[1])
+	if _, err = io.ReadFull(conn, methods); err != nil {
+		return "", err
+	}
+
+	method := byte(socks5NoAuth)
+	if auth != nil {
+		method = socks5UserPassAuth
+	}
+
+	offered := false
+	for _, m := range methods {
+		offered = offered || m == method
+	}
+
+	if !offered {
+		conn.Write([]byte{socks5Version, socks5NoAcceptable})
+		return "", errors.New("socks5: no acceptable authentication methods")
+	}
+
+	if _, err = conn.Write([]byte{socks5Version, method}); err != nil {
+		return "", err
+	}
+
+	if auth != nil {
+		if err = socks5Authenticate(conn, auth); err != nil {
+			return "", err
+		}
+	}
+
+	request := make([]byte, 4)
+	if _, err = io.ReadFull(conn, request); err != nil {
+		return "", err
+	}
+
+	if request[1] != socks5Connect {
+		socks5Reply(conn, socks5CommandNotSupported)
+		return "", fmt.Errorf("socks5: unsupported command %d", request[1])
+	}
+
+	var host []byte
+	switch request[3] {
+	case socks5AddrIPv4:
+		host = make([]byte, net.IPv4len)
+	case socks5AddrIPv6:
+		host = make([]byte, net.IPv6len)
+	case socks5AddrDomain:
+		size := make([]byte, 1)
+		if _, err = io.ReadFull(conn, size); err != nil {
+			return "", err
+		}
+		host = make([]byte, size[0])
+	default:
+		socks5Reply(conn, socks5AddrNotSupported)
+		return "", fmt.Errorf("socks5: unknown address type %d", request[3])
+	}
+
+	port := make([]byte, 2)
+	if _, err = io.ReadFull(conn, host); err != nil {
+		return "", err
+	}
+	if _, err = io.ReadFull(conn, port); err != nil {
+		return "", err
+	}
+
+	if request[3] != socks5AddrDomain {
+		host = []byte(net.IP(host).String())
+	}
+	return net.JoinHostPort(string(host), strconv.Itoa(int(binary.BigEndian.Uint16(port)))), nil
+}
+
+// socks5Authenticate performs the username/password authentication from RFC 1929
+func socks5Authenticate(conn net.Conn, auth SOCKS5Auth) (err error) {
+	header := make([]byte, 2)
+	if _, err = io.ReadFull(conn, header); err != nil {
+		return err
+	}
+
+	username := make([]byte, header[1])
+	if _, err = io.ReadFull(conn, username); err != nil {
+		return err
+	}
+
+	size := make([]byte, 1)
+	if _, err = io.ReadFull(conn, size); err != nil {
+		return err
+	}
+
+	password := make([]byte, size[0])
+	if _, err = io.ReadFull(conn, password); err != nil {
+		return err
+	}
+
+	if header[0] != socks5AuthVersion || !auth(string(username), string(password)) {
+		conn.Write([]byte{socks5AuthVersion, 1})
+		return errProxyAuth
+	}
+
+	_, err = conn.Write([]byte{socks5AuthVersion, 0})
+	return err
+}
+
+// socks5Reply writes a reply with the given code and an empty bound address
+func socks5Reply(conn net.Conn, code byte) (err error) {
+	_, err = conn.Write([]byte{socks5Version, code, 0, socks5AddrIPv4, 0, 0, 0, 0, 0, 0})
+	return err
+}
+
+// socks5DialFailure maps a remote dial error to a SOCKS5 reply code
+func socks5DialFailure(err error) (code byte) {
+	var openErr *ssh.OpenChannelError
+	if !errors.As(err, &openErr) {
+		return socks5GeneralFailure
+	}
+
+	switch openErr.Reason {
+	case ssh.Prohibited:
+		return socks5NotAllowed
+	case ssh.ConnectionFailed:
+		return socks5ConnectionRefused
+	}
+	return socks5HostUnreachable
+}
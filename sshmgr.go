@@ -1,27 +1,46 @@
 package sshmgr
 
 import (
+	"context"
 	"errors"
+	"log/slog"
 	"sync"
 	"sync/atomic"
 	"time"
 
 	"github.com/brunotm/sshmgr/locker"
-	"github.com/pkg/sftp"
 )
 
 var (
 	errManagerClosed = errors.New("manager closed")
 )
 
+const (
+	// defaultMaxSessions matches the sshd MaxSessions default
+	defaultMaxSessions = 10
+)
+
 // Manager for shared ssh and sftp clients
 type Manager struct {
-	mtx        sync.RWMutex
-	gcInterval time.Duration
-	clientTTL  int64
-	locker     *locker.Locker
-	clients    map[string]*Client
-	closeChan  chan struct{}
+	mtx         sync.RWMutex
+	gcInterval  time.Duration
+	clientTTL   int64
+	locker      *locker.Locker
+	breakers    *breakers
+	limits      *limits
+	clients     map[string][]*Client
+	maxSessions int
+	health      HealthCheck
+	retry       RetryPolicy
+	dialer      Dialer
+	closeChan   chan struct{}
+	closeOnce   sync.Once
+	closed      bool
+	releaseChan chan struct{}
+	tunnels     int64
+	rateLimit   *rateLimiter
+	log         *slog.Logger
+	tracer      Tracer
 }
 
 // New creates a new Manager.
@@ -29,47 +48,230 @@ type Manager struct {
 // will be kept alive in the manager without open references.
 // The client last access time is updated when the client is released
 // gcInterval specifies the interval the manager will try to remove unused clients
-func New(clientTTL, gcInterval time.Duration) (manager *Manager) {
+func New(clientTTL, gcInterval time.Duration, options ...Option) (manager *Manager) {
 	manager = &Manager{
-		mtx:        sync.RWMutex{},
-		gcInterval: gcInterval,
-		clientTTL:  int64(clientTTL.Seconds()),
-		locker:     locker.New(),
-		clients:    map[string]*Client{},
-		closeChan:  make(chan struct{}),
+		mtx:         sync.RWMutex{},
+		gcInterval:  gcInterval,
+		clientTTL:   int64(clientTTL.Seconds()),
+		locker:      locker.New(),
+		breakers:    newBreakers(),
+		limits:      newLimits(),
+		clients:     map[string][]*Client{},
+		maxSessions: defaultMaxSessions,
+		closeChan:   make(chan struct{}),
+		releaseChan: make(chan struct{}, 1),
+		log:         newLogger(nil),
+		tracer:      noopTracer{},
+	}
+
+	for _, option := range options {
+		option(manager)
 	}
 
 	go manager.gc()
 	return manager
 }
 
-// Close all running clients and shutdown the manager
+// Close all running clients and shutdown the manager immediately,
+// regardless of clients still in use
 func (m *Manager) Close() {
-	close(m.closeChan)
+	m.stop()
+	m.closeAll()
+}
+
+// Shutdown stops handing out clients and waits until all clients are released
+// or ctx is done, then closes all clients returning the aggregated close errors.
+// The ctx error is included if clients were still in use when ctx was done
+func (m *Manager) Shutdown(ctx context.Context) (err error) {
+	m.stop()
+
+	for m.inUse() > 0 {
+		select {
+		case <-ctx.Done():
+			m.log.Warn("shutdown deadline reached with clients in use", slog.Int("clients", m.inUse()))
+			return errors.Join(ctx.Err(), m.closeAll())
+		case <-m.releaseChan:
+		}
+	}
+
+	return m.closeAll()
 }
 
-func (m *Manager) getClient(id string) (client *Client) {
+// released signals a waiting Shutdown that a client had its last reference dropped.
+// The signal is buffered so a release between the Shutdown check and wait is not lost
+func (m *Manager) released() {
+	select {
+	case <-m.closeChan:
+	default:
+		return
+	}
+
+	select {
+	case m.releaseChan <- struct{}{}:
+	default:
+	}
+}
+
+// stop prevents the manager from handing out clients and stops the gc
+func (m *Manager) stop() {
+	m.closeOnce.Do(func() {
+		m.mtx.Lock()
+		m.closed = true
+		m.mtx.Unlock()
+		close(m.closeChan)
+	})
+}
+
+// inUse returns the number of clients with open references
+func (m *Manager) inUse() (n int) {
 	m.mtx.RLock()
-	client = m.clients[id]
-	m.mtx.RUnlock()
-	return client
+	defer m.mtx.RUnlock()
+
+	for _, pool := range m.clients {
+		for _, client := range pool {
+			if client.refcount() > 0 {
+				n++
+			}
+		}
+	}
+	return n
+}
+
+// closeAll removes and closes all clients
+func (m *Manager) closeAll() (err error) {
+	m.mtx.Lock()
+	clients := m.clients
+	m.clients = map[string][]*Client{}
+	m.mtx.Unlock()
+
+	var errs []error
+	for _, pool := range clients {
+		for _, client := range pool {
+			client.log.Info("removing client on shutdown", slog.Int("refs", int(client.refcount())))
+			if cerr := client.close(); cerr != nil {
+				errs = append(errs, cerr)
+			}
+		}
+	}
+	return errors.Join(errs...)
 }
 
-func (m *Manager) delClient(id string) {
+// acquire returns the least loaded client for id with its reference count incremented.
+// The increment happens under the manager lock so the client cannot be
+// collected between the lookup and the increment
+func (m *Manager) acquire(id string) (client *Client) {
 	m.mtx.RLock()
-	delete(m.clients, id)
-	m.mtx.RUnlock()
+	defer m.mtx.RUnlock()
+
+	for _, c := range m.clients[id] {
+		if client == nil || c.load() < client.load() {
+			client = c
+		}
+	}
+
+	if client != nil {
+		client.incr()
+	}
+	return client
 }
 
-func (m *Manager) setClient(id string, client *Client) {
+// acquireSession returns a client for id with a reserved session slot and its
+// reference count incremented, or nil if all clients for id are saturated
+func (m *Manager) acquireSession(id string) (client *Client) {
 	m.mtx.RLock()
-	m.clients[id] = client
-	m.mtx.RUnlock()
+	defer m.mtx.RUnlock()
+
+	for _, c := range m.clients[id] {
+		if c.reserveSession() {
+			c.incr()
+			return c
+		}
+	}
+	return nil
+}
+
+// evictIdle closes the least recently used client without references,
+// restricted to host if not empty. Returns false if there are no idle clients
+func (m *Manager) evictIdle(host string) (evicted bool) {
+	m.mtx.Lock()
+
+	var lru *Client
+	for _, pool := range m.clients {
+		for _, client := range pool {
+			if client.refcount() != 0 || (host != "" && client.addr != host) {
+				continue
+			}
+
+			if lru == nil || atomic.LoadInt64(&client.atime) < atomic.LoadInt64(&lru.atime) {
+				lru = client
+			}
+		}
+	}
+
+	if lru == nil {
+		m.mtx.Unlock()
+		return false
+	}
+
+	// Clients are closed without holding the manager lock
+	m.removeLocked(lru)
+	m.mtx.Unlock()
+
+	lru.log.Info("evicting idle client to make room for a new connection")
+	lru.close()
+	return true
+}
+
+// delClient removes client from the manager if it is still registered
+func (m *Manager) delClient(client *Client) {
+	m.mtx.Lock()
+	m.removeLocked(client)
+	m.mtx.Unlock()
+}
+
+// removeLocked removes client from its pool, must be called with m.mtx held
+func (m *Manager) removeLocked(client *Client) {
+	pool := m.clients[client.id]
+	for i := range pool {
+		if pool[i] == client {
+			pool = append(pool[:i:i], pool[i+1:]...)
+			break
+		}
+	}
+
+	if len(pool) == 0 {
+		delete(m.clients, client.id)
+		return
+	}
+	m.clients[client.id] = pool
+}
+
+// addClient adds client to the pool of its config, failing if the manager was closed
+func (m *Manager) addClient(client *Client) (err error) {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+
+	if m.closed {
+		return errManagerClosed
+	}
+	m.clients[client.id] = append(m.clients[client.id], client)
+	return nil
 }
 
 // SSHClient returns an active managed client or create a new one on demand.
 // Clients must be closed after usage so they can be removed when there are no references
 func (m *Manager) SSHClient(config ClientConfig) (client *Client, err error) {
+	return m.SSHClientContext(context.Background(), config)
+}
+
+// SSHClientContext is like SSHClient but uses ctx for dialing and tracing
+func (m *Manager) SSHClientContext(ctx context.Context, config ClientConfig) (client *Client, err error) {
+	if config, err = config.normalize(); err != nil {
+		return nil, err
+	}
+
+	ctx, span := m.tracer.Start(ctx, "sshmgr.SSHClient", configAttrs(config)...)
+	defer func() { endSpan(span, err) }()
 
 	select {
 	case <-m.closeChan:
@@ -77,56 +279,132 @@ func (m *Manager) SSHClient(config ClientConfig) (client *Client, err error) {
 	default:
 	}
 
+	// Fail fast without waiting for the locker if the host is suspended
+	if err = m.breakers.check(config.addr(), time.Now()); err != nil {
+		return nil, err
+	}
+
 	id := config.id()
+	_, lockSpan := m.tracer.Start(ctx, "sshmgr.locker.wait")
 	m.locker.Lock(id)
+	lockSpan.End()
 	defer m.locker.Unlock(id)
 
-	// Get a client for this config
-	client = m.getClient(config.id())
-
-	if client != nil {
-		// Check if client is valid
-		_, _, err = client.client.SendRequest("sshmgr", true, nil)
+	// Get the least loaded live client for this config
+	for client = m.acquire(id); client != nil; client = m.acquire(id) {
+		// Check if client is valid, unless a recent keepalive succeeded
+		err = nil
+		if client.needsProbe() {
+			_, probeSpan := m.tracer.Start(ctx, "sshmgr.probe")
+			err = client.probe(client.probeTimeout())
+			endSpan(probeSpan, err)
+		}
 		if err == nil {
-			client.incr()
-			client.conn.SetDeadline(time.Now().Add(config.ConnDeadline))
+			client.setDeadline(config.ConnDeadline)
+			client.log.Debug("reusing client", slog.Int("refs", int(client.refcount())))
+			span.SetAttributes(slog.Bool("reused", true))
 			return client, nil
 		}
-		m.delClient(id)
+		client.log.Warn("client liveness probe failed, discarding", slog.Any("error", err))
+		client.decr()
+		m.delClient(client)
+		client.close()
 	}
 
-	if client, err = newClient(config); err != nil {
+	if err = m.breakers.allow(config.addr(), time.Now()); err != nil {
+		return nil, err
+	}
+
+	if client, err = m.connect(ctx, config); err != nil {
+		return nil, err
+	}
+	span.SetAttributes(slog.Bool("reused", false))
+	return client, nil
+}
+
+// connect creates a new client for config, adds it to the manager with its
+// reference count incremented and sets the current deadline.
+// The caller must hold the locker for the config id
+func (m *Manager) connect(ctx context.Context, config ClientConfig) (client *Client, err error) {
+	if client, err = m.newClient(ctx, config); err != nil {
 		return nil, err
 	}
 
-	// Add the client to the manager, increment the reference count
-	// and set the current deadline
 	client.incr()
-	m.setClient(id, client)
+	if err = m.addClient(client); err != nil {
+		client.close()
+		return nil, err
+	}
+
+	client.start()
+	client.log.Info("client connected", slog.Int("pool", m.poolSize(client.id)))
+
+	client.setDeadline(config.ConnDeadline)
+	return client, nil
+}
+
+// sibling returns a client for the same config as c with a reserved session slot,
+// opening a new connection when all clients in the pool are saturated.
+// The returned client holds a reference that must be released with the session
+func (m *Manager) sibling(ctx context.Context, c *Client) (client *Client, err error) {
+	if client = m.acquireSession(c.id); client != nil {
+		return client, nil
+	}
+
+	m.locker.Lock(c.id)
+	defer m.locker.Unlock(c.id)
+
+	// Another caller may have opened a connection while waiting for the locker
+	if client = m.acquireSession(c.id); client != nil {
+		return client, nil
+	}
+
+	if err = m.breakers.allow(c.addr, time.Now()); err != nil {
+		return nil, err
+	}
 
-	client.conn.SetDeadline(time.Now().Add(config.ConnDeadline))
+	if client, err = m.connect(ctx, c.config); err != nil {
+		return nil, err
+	}
+	client.reserveSession()
+	client.log.Debug("opened additional connection for saturated pool")
 	return client, nil
 }
 
+// poolSize returns the number of clients for id
+func (m *Manager) poolSize(id string) (n int) {
+	m.mtx.RLock()
+	defer m.mtx.RUnlock()
+	return len(m.clients[id])
+}
+
 // SFTPClient creates a session from a active managed client or create a new one on demand.
 // Clients must be closed after usage so they can be removed when they have no references
 func (m *Manager) SFTPClient(config ClientConfig) (session *SFTPClient, err error) {
+	return m.SFTPClientContext(context.Background(), config)
+}
+
+// SFTPClientContext is like SFTPClient but uses ctx for dialing and tracing
+func (m *Manager) SFTPClientContext(ctx context.Context, config ClientConfig) (session *SFTPClient, err error) {
+	ctx, span := m.tracer.Start(ctx, "sshmgr.SFTPClient", configAttrs(config)...)
+	defer func() { endSpan(span, err) }()
 
 	// Get a client for this config
-	client, err := m.SSHClient(config)
+	client, err := m.SSHClientContext(ctx, config)
 	if err != nil {
 		return nil, err
 	}
 
-	// Create a SFTP session
-	sftpClient, err := sftp.NewClient(client.client)
+	// Get a pooled sftp session on the client or a sibling connection
+	sess, err := client.sftpSession(ctx)
 	if err != nil {
+		client.Close()
 		return nil, err
 	}
 
 	msftp := &SFTPClient{}
 	msftp.client = client
-	msftp.Client = sftpClient
+	msftp.sess = sess
 
 	return msftp, nil
 }
@@ -138,37 +416,48 @@ func (m *Manager) gc() {
 	for {
 		select {
 		case <-m.closeChan:
-			m.collect(true)
 			return
 
 		case <-ticker.C:
-			m.collect(false)
+			m.collect()
 		}
 	}
 }
 
-// collect unreferenced and expired clients
-func (m *Manager) collect(shutdown bool) {
+// collect unreferenced and expired clients. Unreferenced additional
+// connections of a pool are collected before their ttl to shrink it
+// back to a single connection once idle
+func (m *Manager) collect() {
 	now := time.Now().Unix()
+	var expired, live []*Client
 
 	m.mtx.Lock()
-	for id := range m.clients {
-		m.locker.Lock(id)
-		client := m.clients[id]
-
-		if shutdown {
-			delete(m.clients, id)
-			client.Close()
-			continue
-		}
+	for _, pool := range m.clients {
+		remaining := len(pool)
+		for _, client := range pool {
+			live = append(live, client)
+			if client.refcount() != 0 {
+				continue
+			}
 
-		if client.refcount() == 0 {
-			if (now - atomic.LoadInt64(&client.atime)) >= m.clientTTL {
-				delete(m.clients, id)
-				client.Close()
+			if remaining > 1 || (now-atomic.LoadInt64(&client.atime)) >= m.clientTTL {
+				m.removeLocked(client)
+				expired = append(expired, client)
+				remaining--
 			}
 		}
-		m.locker.Unlock(id)
 	}
 	m.mtx.Unlock()
+
+	// Clients and sessions are closed without holding the manager lock
+	for _, client := range live {
+		if n := client.expireSFTP(m.clientTTL); n > 0 {
+			client.log.Debug("closed idle sftp sessions", slog.Int("count", n))
+		}
+	}
+
+	for _, client := range expired {
+		client.log.Info("removing expired or surplus client")
+		client.close()
+	}
 }
@@ -0,0 +1,210 @@
+package sshmgr
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+var errTestClose = errors.New("test close error")
+
+// closeErrDialer dials connections whose Close fails with errTestClose
+type closeErrDialer struct{}
+
+func (closeErrDialer) DialContext(ctx context.Context, network, addr string) (conn net.Conn, err error) {
+	if conn, err = (&net.Dialer{}).DialContext(ctx, network, addr); err != nil {
+		return nil, err
+	}
+	return closeErrConn{conn}, nil
+}
+
+type closeErrConn struct {
+	net.Conn
+}
+
+func (c closeErrConn) Close() (err error) {
+	c.Conn.Close()
+	return errTestClose
+}
+
+func TestShutdownWaitsForRelease(t *testing.T) {
+	server := newTestServer(t)
+	manager := New(time.Minute, time.Minute)
+
+	client, err := manager.SSHClient(server.clientConfig())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	done := make(chan error)
+	go func() {
+		done <- manager.Shutdown(context.Background())
+	}()
+
+	select {
+	case err = <-done:
+		t.Fatalf("shutdown returned with a client in use: %v", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	if _, err = manager.SSHClient(server.clientConfig()); !errors.Is(err, errManagerClosed) {
+		t.Fatalf("expected new clients to be refused, got: %v", err)
+	}
+
+	// The client stays usable until released
+	if _, err = client.CombinedOutput("true", nil); err != nil {
+		t.Fatal(err)
+	}
+	client.Close()
+
+	select {
+	case err = <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("shutdown was not signalled on release")
+	}
+
+	if stats := manager.Stats(); stats.Clients != 0 || stats.Connections != 0 {
+		t.Fatalf("expected all clients closed, got: %+v", stats)
+	}
+}
+
+func TestShutdownDeadline(t *testing.T) {
+	server := newTestServer(t)
+	manager := New(time.Minute, time.Minute)
+
+	// Clients closed on the deadline fail so their errors are joined with the context error
+	config := server.clientConfig()
+	config.Dialer = closeErrDialer{}
+	client, err := manager.SSHClient(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	err = manager.Shutdown(ctx)
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("expected the deadline error, got: %v", err)
+	}
+
+	if !errors.Is(err, errTestClose) {
+		t.Fatalf("expected the close error joined with the deadline error, got: %v", err)
+	}
+
+	if stats := manager.Stats(); stats.Clients != 0 {
+		t.Fatalf("expected clients to be closed after the deadline, got: %+v", stats)
+	}
+}
+
+// poolSessions returns the open sessions of each connection in the pool of config
+func poolSessions(m *Manager, config ClientConfig) (sessions []int32) {
+	m.mtx.RLock()
+	defer m.mtx.RUnlock()
+
+	for _, client := range m.clients[config.id()] {
+		sessions = append(sessions, atomic.LoadInt32(&client.sessions))
+	}
+	return sessions
+}
+
+func TestSessionPooling(t *testing.T) {
+	server := newTestServer(t)
+	manager := New(time.Minute, time.Minute, WithMaxSessions(3))
+	defer manager.Close()
+
+	config := server.clientConfig()
+	client, err := manager.SSHClient(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Sessions beyond the limit are opened on a second connection
+	var sessions []*session
+	for i := 0; i < 4; i++ {
+		s, err := client.newSession(context.Background(), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		sessions = append(sessions, s)
+	}
+
+	if n := poolSessions(manager, config); len(n) != 2 || n[0] != 3 || n[1] != 1 {
+		t.Fatalf("expected a second connection for the saturated pool, got sessions: %v", n)
+	}
+	if sessions[3].conn == client {
+		t.Fatal("expected the last session on the additional connection")
+	}
+
+	for _, s := range sessions {
+		s.Close()
+	}
+
+	// New sessions are balanced across the pooled connections
+	sessions = sessions[:0]
+	for i := 0; i < 4; i++ {
+		c, err := manager.SSHClient(config)
+		if err != nil {
+			t.Fatal(err)
+		}
+		s, err := c.newSession(context.Background(), nil)
+		c.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		sessions = append(sessions, s)
+	}
+
+	if n := poolSessions(manager, config); len(n) != 2 || n[0] != 2 || n[1] != 2 {
+		t.Fatalf("expected sessions balanced across connections, got: %v", n)
+	}
+
+	// Commands run concurrently over both connections
+	var wg sync.WaitGroup
+	errs := make(chan error, 6)
+	for i := 0; i < 6; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, err := client.CombinedOutput("sleep 0.1", nil)
+			errs <- err
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, s := range sessions {
+		s.Close()
+	}
+
+	// The additional connection is collected once idle, the primary is kept until its ttl
+	manager.collect()
+	if stats := manager.Stats(); stats.Clients != 1 || stats.Connections != 1 {
+		t.Fatalf("expected the pool to shrink to a single connection, got: %+v", stats)
+	}
+
+	if c := manager.acquire(config.id()); c != client {
+		t.Fatal("expected the primary connection to be kept")
+	} else {
+		c.Close()
+	}
+
+	client.Close()
+	manager.collect()
+	if stats := manager.Stats(); stats.Clients != 1 {
+		t.Fatalf("expected the idle primary to be kept until its ttl, got: %+v", stats)
+	}
+}
@@ -0,0 +1,46 @@
+package sshmgr
+
+import (
+	"sync/atomic"
+)
+
+// Stats reports the state of the manager
+type Stats struct {
+	// Clients is the number of clients held by the manager
+	Clients int
+	// Sessions is the number of open sessions across all clients
+	Sessions int
+	// SFTPSessions is the number of pooled sftp sessions across all clients
+	SFTPSessions int
+	// InUse is the number of clients with open references
+	InUse int
+	// Connections is the number of open connections
+	Connections int
+	// Dialing is the number of dials and handshakes in progress
+	Dialing int
+	// Waiting is the number of callers waiting for a connection or dial slot
+	Waiting int
+	// Tunnels is the number of open forwarding tunnels and SOCKS5 proxies
+	Tunnels int
+	// Breakers is the circuit breaker state of hosts with recent failures
+	Breakers map[string]BreakerStats
+}
+
+// Stats returns a snapshot of the manager state
+func (m *Manager) Stats() (stats Stats) {
+	m.mtx.RLock()
+	for _, pool := range m.clients {
+		stats.Clients += len(pool)
+		for _, client := range pool {
+			stats.Sessions += int(atomic.LoadInt32(&client.sessions))
+			stats.SFTPSessions += client.pooledSFTPCount()
+		}
+	}
+	m.mtx.RUnlock()
+
+	stats.InUse = m.inUse()
+	stats.Connections, stats.Dialing, stats.Waiting = m.limits.stats()
+	stats.Tunnels = int(atomic.LoadInt64(&m.tunnels))
+	stats.Breakers = m.breakers.stats()
+	return stats
+}
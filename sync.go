@@ -0,0 +1,461 @@
+package sshmgr
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"path"
+	"sort"
+	"strings"
+)
+
+// SyncOptions configures Sync
+type SyncOptions struct {
+	TransferOptions
+
+	// Checksum compares files of the same size by their sha256 digest instead of
+	// their modification time. Remote digests are computed on the remote host,
+	// see Client.Checksums, or by reading the files over sftp if unavailable
+	Checksum bool
+
+	// Delete removes remote files and directories not present locally.
+	// Excluded paths are never deleted, and directories still holding
+	// excluded entries are kept
+	Delete bool
+
+	// DryRun reports the changes without applying them
+	DryRun bool
+}
+
+// SyncSummary reports the changes made by Sync. Paths are slash separated
+// and relative to the synchronized roots, directories have a trailing slash
+type SyncSummary struct {
+	// Created lists files, directories and links created on the remote host
+	Created []string
+	// Updated lists changed files and links transferred again
+	Updated []string
+	// Deleted lists extraneous remote files and directories removed
+	Deleted []string
+	// Unchanged is the number of files and links already up to date
+	Unchanged int
+	// Bytes is the number of file bytes transferred
+	Bytes int64
+}
+
+// Sync makes the remote directory tree match the local one, transferring only new
+// and changed files. Files are compared by size and modification time, or by
+// checksum. Modification times are always preserved so unchanged files are
+// detected on later runs
+func (s *SFTPClient) Sync(ctx context.Context, local, remote string, options SyncOptions) (summary SyncSummary, err error) {
+	ctx, span := s.client.tracer.Start(ctx, "sshmgr.sftp.sync", s.client.attrs...)
+	defer func() { endSpan(span, err) }()
+
+	options.PreserveTimes = true
+	src, dst := localFS{}, &remoteFS{s}
+
+	srcTree, err := listTree(src, local, options.TransferOptions)
+	if err != nil {
+		return summary, err
+	}
+
+	dstTree, err := listTree(dst, remote, options.TransferOptions)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return summary, err
+	}
+
+	plan := syncPlan{src: srcTree, dst: dstTree, remove: map[string]bool{}}
+	if err = plan.compare(ctx, s, options.Checksum); err != nil {
+		return summary, err
+	}
+
+	if options.Delete {
+		plan.extraneous(s.client.log)
+	}
+
+	if len(options.Include) > 0 {
+		plan.prune()
+	}
+
+	summary = plan.summary()
+	s.client.log.Info("sync planned", slog.Int("created", len(summary.Created)),
+		slog.Int("updated", len(summary.Updated)), slog.Int("deleted", len(summary.Deleted)),
+		slog.Int("unchanged", summary.Unchanged), slog.Bool("dry_run", options.DryRun))
+
+	if options.DryRun {
+		return summary, nil
+	}
+
+	copied, err := plan.apply(ctx, s.client.log, src, dst, local, remote,
+		s.client.mgr.limiters(options.RateLimit), options.TransferOptions)
+	if err != nil || !options.Verify {
+		return summary, err
+	}
+	return summary, s.client.verify(ctx, verifiedFiles(copied, true), true)
+}
+
+// treeEntry is a file, directory or link in a tree listing.
+// Directories holding entries omitted from the listing are partial
+type treeEntry struct {
+	path    string
+	info    os.FileInfo
+	target  string
+	partial bool
+}
+
+func (e treeEntry) kind() (kind os.FileMode) {
+	return e.info.Mode().Type() & (os.ModeDir | os.ModeSymlink)
+}
+
+// listTree lists the tree at root by slash separated relative path,
+// applying the filters and symlink policy of options
+func listTree(fs transferFS, root string, options TransferOptions) (tree map[string]treeEntry, err error) {
+	info, err := fs.Stat(root)
+	if err != nil {
+		return nil, err
+	}
+
+	if !info.IsDir() {
+		return nil, fmt.Errorf("%s: not a directory", root)
+	}
+
+	tree = map[string]treeEntry{}
+	return tree, listDir(fs, root, "", options, tree, 0)
+}
+
+func listDir(fs transferFS, dir, rel string, options TransferOptions, tree map[string]treeEntry, links int) (err error) {
+	entries, err := fs.ReadDir(dir)
+	if err != nil {
+		return fmt.Errorf("%s: %w", dir, err)
+	}
+
+	for _, info := range entries {
+		entry := treeEntry{path: fs.Join(dir, info.Name()), info: info}
+		erel := path.Join(rel, info.Name())
+		elinks := links
+
+		if info.Mode()&os.ModeSymlink != 0 {
+			switch options.Symlinks {
+			case SymlinkCopy:
+				if entry.target, err = fs.ReadLink(entry.path); err != nil {
+					return fmt.Errorf("%s: %w", entry.path, err)
+				}
+
+			case SymlinkFollow:
+				if entry.info, err = fs.Stat(entry.path); err != nil {
+					markPartial(tree, rel)
+					continue
+				}
+				if elinks++; elinks > maxSymlinkDepth {
+					return fmt.Errorf("%s: too many levels of symbolic links", entry.path)
+				}
+
+			default:
+				markPartial(tree, rel)
+				continue
+			}
+		}
+
+		dir := entry.info.IsDir()
+		if !dir && entry.target == "" && !entry.info.Mode().IsRegular() {
+			markPartial(tree, rel)
+			continue
+		}
+
+		if !options.match(erel, dir) {
+			markPartial(tree, rel)
+			continue
+		}
+
+		tree[erel] = entry
+		if dir {
+			if err = listDir(fs, entry.path, erel, options, tree, elinks); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// prunedDirs returns the directories of rels holding none of the files and links of
+// rels, which are not created with Include patterns as by SFTPClient.Upload
+func prunedDirs(tree map[string]treeEntry, rels []string) (pruned map[string]bool) {
+	used := map[string]bool{".": true}
+	for _, rel := range rels {
+		if !tree[rel].info.IsDir() {
+			for dir := path.Dir(rel); !used[dir]; dir = path.Dir(dir) {
+				used[dir] = true
+			}
+		}
+	}
+
+	pruned = map[string]bool{}
+	for _, rel := range rels {
+		if tree[rel].info.IsDir() && !used[rel] {
+			pruned[rel] = true
+		}
+	}
+	return pruned
+}
+
+// markPartial marks the directory rel and its parents as holding omitted entries
+func markPartial(tree map[string]treeEntry, rel string) {
+	for ; rel != "" && rel != "."; rel = path.Dir(rel) {
+		e := tree[rel]
+		if e.partial {
+			return
+		}
+		e.partial = true
+		tree[rel] = e
+	}
+}
+
+// syncPlan holds the changes needed to make the dst tree match src
+type syncPlan struct {
+	src       map[string]treeEntry
+	dst       map[string]treeEntry
+	create    []string
+	update    []string
+	remove    map[string]bool
+	unchanged int
+}
+
+// compare classifies the source entries as new, changed or unchanged,
+// scheduling the removal of destination entries of a different kind
+func (p *syncPlan) compare(ctx context.Context, s *SFTPClient, checksum bool) (err error) {
+	var candidates []string
+
+	for _, rel := range sortedKeys(p.src) {
+		se := p.src[rel]
+		de, ok := p.dst[rel]
+
+		switch {
+		case !ok:
+			p.create = append(p.create, rel)
+
+		case se.kind() != de.kind():
+			p.removeTree(rel)
+			p.update = append(p.update, rel)
+
+		case se.info.IsDir():
+
+		case se.target != "" || de.target != "":
+			if se.target != de.target {
+				p.update = append(p.update, rel)
+			} else {
+				p.unchanged++
+			}
+
+		case se.info.Size() != de.info.Size():
+			p.update = append(p.update, rel)
+
+		case checksum:
+			candidates = append(candidates, rel)
+
+		case se.info.ModTime().Unix() != de.info.ModTime().Unix():
+			p.update = append(p.update, rel)
+
+		default:
+			p.unchanged++
+		}
+	}
+
+	if len(candidates) == 0 {
+		return nil
+	}
+
+	sums, err := p.remoteSums(ctx, s, candidates)
+	if err != nil {
+		return err
+	}
+
+	for _, rel := range candidates {
+		f, err := os.Open(p.src[rel].path)
+		if err != nil {
+			return err
+		}
+		sum, err := readerSHA256(f)
+		f.Close()
+		if err != nil {
+			return err
+		}
+
+		if sum != sums[p.dst[rel].path] {
+			p.update = append(p.update, rel)
+		} else {
+			p.unchanged++
+		}
+	}
+
+	sort.Strings(p.update)
+	return nil
+}
+
+// remoteSums returns the sha256 digests of the remote candidates by path, computed on
+// the remote host, or by reading the files over sftp if no checksum command is available
+func (p *syncPlan) remoteSums(ctx context.Context, s *SFTPClient, candidates []string) (sums map[string]string, err error) {
+	paths := make([]string, len(candidates))
+	for i, rel := range candidates {
+		paths[i] = p.dst[rel].path
+	}
+
+	if sums, err = s.client.Checksums(ctx, paths, SHA256); err == nil {
+		return sums, nil
+	}
+	s.client.log.Warn("remote checksum failed, reading files over sftp", slog.Any("error", err))
+
+	sums = make(map[string]string, len(paths))
+	for _, p := range paths {
+		if err = ctx.Err(); err != nil {
+			return nil, err
+		}
+
+		f, err := s.Open(p)
+		if err != nil {
+			return nil, err
+		}
+		sums[p], err = readerSHA256(f)
+		f.Close()
+		if err != nil {
+			return nil, err
+		}
+	}
+	return sums, nil
+}
+
+// extraneous schedules the removal of destination entries not in the source.
+// Directories still holding excluded entries would not be empty once their
+// listed contents are removed, so they are kept
+func (p *syncPlan) extraneous(log *slog.Logger) {
+	for rel, e := range p.dst {
+		if _, ok := p.src[rel]; ok {
+			continue
+		}
+
+		if e.partial {
+			log.Info("keeping extraneous directory with excluded entries", slog.String("path", e.path))
+			continue
+		}
+		p.remove[rel] = true
+	}
+}
+
+// prune drops the planned directories holding no planned files or links
+func (p *syncPlan) prune() {
+	pruned := prunedDirs(p.src, append(append([]string{}, p.create...), p.update...))
+	keep := func(rels []string) (kept []string) {
+		for _, rel := range rels {
+			if !pruned[rel] {
+				kept = append(kept, rel)
+			}
+		}
+		return kept
+	}
+	p.create = keep(p.create)
+	p.update = keep(p.update)
+}
+
+// removeTree schedules the removal of the destination entry rel and its contents
+func (p *syncPlan) removeTree(rel string) {
+	for drel := range p.dst {
+		if drel == rel || strings.HasPrefix(drel, rel+"/") {
+			p.remove[drel] = true
+		}
+	}
+}
+
+func (p *syncPlan) summary() (summary SyncSummary) {
+	display := func(rels []string, tree map[string]treeEntry) (names []string) {
+		for _, rel := range rels {
+			if e, ok := tree[rel]; ok && e.info.IsDir() {
+				rel += "/"
+			}
+			names = append(names, rel)
+		}
+		return names
+	}
+
+	summary.Created = display(p.create, p.src)
+	summary.Updated = display(p.update, p.src)
+
+	summary.Deleted = display(p.removals(), p.dst)
+	sort.Strings(summary.Deleted)
+
+	summary.Unchanged = p.unchanged
+	for _, rel := range append(append([]string{}, p.create...), p.update...) {
+		if e := p.src[rel]; e.target == "" && e.info.Mode().IsRegular() {
+			summary.Bytes += e.info.Size()
+		}
+	}
+	return summary
+}
+
+// apply removes, creates and transfers the planned entries,
+// returning the copied files if they are to be verified
+func (p *syncPlan) apply(ctx context.Context, log *slog.Logger, src, dst transferFS,
+	srcRoot, dstRoot string, limits []*rateLimiter, options TransferOptions) (copied []transferJob, err error) {
+
+	for _, rel := range p.removals() {
+		if err = ctx.Err(); err != nil {
+			return nil, err
+		}
+		if err = dst.Remove(dst.Join(dstRoot, rel)); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return nil, fmt.Errorf("%s: %w", rel, err)
+		}
+	}
+
+	if err = dst.MkdirAll(dstRoot); err != nil {
+		return nil, err
+	}
+
+	t := newTransfer(ctx, log, src, dst, srcRoot, limits, options)
+	changes := append(append([]string{}, p.create...), p.update...)
+	sort.Strings(changes)
+
+	for _, rel := range changes {
+		if t.ctx.Err() != nil {
+			break
+		}
+
+		e := p.src[rel]
+		job := transferJob{src: e.path, dst: dst.Join(dstRoot, rel), info: e.info}
+
+		switch {
+		case e.target != "":
+			err = t.copyLink(job)
+		case e.info.IsDir():
+			if err = dst.MkdirAll(job.dst); err == nil {
+				t.dirs = append(t.dirs, job)
+			}
+		default:
+			t.queue(job)
+		}
+
+		if err != nil {
+			t.fail(fmt.Errorf("%s: %w", rel, err))
+		}
+	}
+
+	err = t.wait()
+	return t.copied, err
+}
+
+// removals returns the destination entries to remove in reverse order,
+// so directory contents are removed before the directories
+func (p *syncPlan) removals() (rels []string) {
+	for rel := range p.remove {
+		rels = append(rels, rel)
+	}
+	sort.Sort(sort.Reverse(sort.StringSlice(rels)))
+	return rels
+}
+
+func sortedKeys(tree map[string]treeEntry) (keys []string) {
+	keys = make([]string, 0, len(tree))
+	for key := range tree {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,114 @@
+package sshmgr
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestSync(t *testing.T) {
+	server := newTestServer(t)
+	manager := New(time.Minute, time.Minute)
+	defer manager.Close()
+
+	session, err := manager.SFTPClient(server.clientConfig())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer session.Close()
+
+	local := t.TempDir()
+	remote := filepath.Join(t.TempDir(), "remote")
+	writeTree(t, local, map[string]string{
+		"a.conf":     "a",
+		"b.conf":     "b",
+		"sub/c.conf": "c",
+	})
+
+	ctx := context.Background()
+	summary, err := session.Sync(ctx, local, remote, SyncOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := SyncSummary{Created: []string{"a.conf", "b.conf", "sub/", "sub/c.conf"}, Bytes: 3}
+	if !reflect.DeepEqual(summary, expected) {
+		t.Fatalf("expected %+v, got: %+v", expected, summary)
+	}
+
+	// Unchanged trees transfer nothing
+	if summary, err = session.Sync(ctx, local, remote, SyncOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	if summary.Unchanged != 3 || len(summary.Created)+len(summary.Updated) != 0 {
+		t.Fatalf("expected an unchanged tree, got: %+v", summary)
+	}
+
+	// Same size and mtime changes are only detected by checksum
+	writeTree(t, local, map[string]string{"a.conf": "x", "d.conf": "dd"})
+	info, _ := os.Stat(filepath.Join(remote, "a.conf"))
+	os.Chtimes(filepath.Join(local, "a.conf"), info.ModTime(), info.ModTime())
+	os.Remove(filepath.Join(local, "b.conf"))
+	writeTree(t, remote, map[string]string{"extra/e.conf": "e"})
+
+	options := SyncOptions{Delete: true, DryRun: true}
+	if summary, err = session.Sync(ctx, local, remote, options); err != nil {
+		t.Fatal(err)
+	}
+
+	expected = SyncSummary{
+		Created:   []string{"d.conf"},
+		Deleted:   []string{"b.conf", "extra/", "extra/e.conf"},
+		Unchanged: 2,
+		Bytes:     2,
+	}
+	if !reflect.DeepEqual(summary, expected) {
+		t.Fatalf("expected %+v, got: %+v", expected, summary)
+	}
+
+	assertTree(t, remote, map[string]string{"a.conf": "a", "b.conf": "b", "sub/c.conf": "c", "extra/e.conf": "e"})
+
+	options = SyncOptions{Delete: true, Checksum: true}
+	if summary, err = session.Sync(ctx, local, remote, options); err != nil {
+		t.Fatal(err)
+	}
+
+	if !reflect.DeepEqual(summary.Updated, []string{"a.conf"}) {
+		t.Fatalf("expected a.conf to be updated by checksum, got: %+v", summary)
+	}
+
+	assertTree(t, remote, map[string]string{"a.conf": "x", "d.conf": "dd", "sub/c.conf": "c"})
+
+	// Extraneous directories holding excluded entries are kept
+	writeTree(t, remote, map[string]string{"keep/x.log": "x", "keep/y.conf": "y", "keep/sub/z.log": "z"})
+	options = SyncOptions{Delete: true, TransferOptions: TransferOptions{Exclude: []string{"*.log"}}}
+	if summary, err = session.Sync(ctx, local, remote, options); err != nil {
+		t.Fatal(err)
+	}
+
+	if !reflect.DeepEqual(summary.Deleted, []string{"keep/y.conf"}) {
+		t.Fatalf("expected only keep/y.conf to be deleted, got: %+v", summary)
+	}
+
+	assertTree(t, remote, map[string]string{"a.conf": "x", "d.conf": "dd", "sub/c.conf": "c",
+		"keep/x.log": "x", "keep/sub/z.log": "z"})
+
+	// Directories without included files are not created
+	writeTree(t, local, map[string]string{"logs/app.log": "l", "conf/e.conf": "e"})
+	included := filepath.Join(t.TempDir(), "included")
+	options = SyncOptions{TransferOptions: TransferOptions{Include: []string{"*.conf"}}}
+	if summary, err = session.Sync(ctx, local, included, options); err != nil {
+		t.Fatal(err)
+	}
+
+	expected = SyncSummary{Created: []string{"a.conf", "conf/", "conf/e.conf", "d.conf", "sub/", "sub/c.conf"}, Bytes: 5}
+	if !reflect.DeepEqual(summary, expected) {
+		t.Fatalf("expected %+v, got: %+v", expected, summary)
+	}
+	if _, err = os.Stat(filepath.Join(included, "logs")); !os.IsNotExist(err) {
+		t.Fatalf("expected logs not to be created, got: %v", err)
+	}
+}
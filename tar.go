@@ -0,0 +1,493 @@
+package sshmgr
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log/slog"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// TarCompression is the compression of tar streams
+type TarCompression int
+
+const (
+	// TarUncompressed streams plain tar archives
+	TarUncompressed TarCompression = iota
+	// TarGzip compresses tar streams with gzip
+	TarGzip
+	// TarZstd compresses tar streams with zstd, which requires the zstd command
+	// on both hosts. Transfers fail with ErrZstdUnavailable if missing locally
+	TarZstd
+)
+
+// ErrZstdUnavailable is returned by zstd compressed tar transfers when the
+// zstd command is not found on the local host
+var ErrZstdUnavailable = errors.New("zstd command unavailable")
+
+// TarOptions configures tar stream transfers
+type TarOptions struct {
+	TransferOptions
+
+	// Compression is the compression of the tar stream, uncompressed by default
+	Compression TarCompression
+}
+
+// remote returns the remote commands compressing and decompressing the stream
+func (c TarCompression) remote() (compress, decompress string) {
+	switch c {
+	case TarGzip:
+		return " | gzip -c", "gzip -dc | "
+	case TarZstd:
+		return " | zstd -q -c", "zstd -q -dc | "
+	default:
+		return "", ""
+	}
+}
+
+// check returns ErrZstdUnavailable if the local command of the compression is not found
+func (c TarCompression) check() (err error) {
+	if c != TarZstd {
+		return nil
+	}
+	if _, err = exec.LookPath("zstd"); err != nil {
+		return fmt.Errorf("%w: %w", ErrZstdUnavailable, err)
+	}
+	return nil
+}
+
+// TarUpload copies the local file or directory tree at local to remote as a single
+// tar stream extracted by tar on the remote host, avoiding the per file round trips
+// of SFTPClient.Upload whose semantics it otherwise follows. Ownership is never
+// transferred, and files are owned by the remote user
+func (c *Client) TarUpload(ctx context.Context, local, remote string, options TarOptions) (err error) {
+	ctx, span := c.tracer.Start(ctx, "sshmgr.tar.upload", c.attrs...)
+	defer func() { endSpan(span, err) }()
+
+	if err = options.Compression.check(); err != nil {
+		return err
+	}
+
+	info, err := os.Stat(local)
+	if err != nil {
+		return err
+	}
+
+	// Single files are extracted under their destination name in its directory
+	dir := remote
+	tree := map[string]treeEntry{".": {path: local, info: info}}
+	if !info.IsDir() {
+		dir = path.Dir(remote)
+		tree = map[string]treeEntry{path.Base(remote): {path: local, info: info}}
+	} else if err = listDir(localFS{}, local, "", options.TransferOptions, tree, 0); err != nil {
+		return err
+	}
+
+	// With Include patterns directories are only archived if they hold files, as by Upload
+	if len(options.Include) > 0 {
+		for rel := range prunedDirs(tree, sortedKeys(tree)) {
+			delete(tree, rel)
+		}
+	}
+
+	var files []verifiedFile
+	progress := newProgressTracker(options.Progress, local, 0)
+	for rel, e := range tree {
+		if e.info.Mode().IsRegular() && e.target == "" {
+			progress.grow(e.info.Size())
+			files = append(files, verifiedFile{local: e.path, remote: path.Join(dir, rel)})
+		}
+	}
+
+	flags := " -o"
+	if options.PreservePermissions {
+		flags += " -p"
+	}
+	if !options.PreserveTimes {
+		flags += " -m"
+	}
+
+	_, decompress := options.Compression.remote()
+	cmd := fmt.Sprintf("mkdir -p -- %[1]s && %[2]star -x%[3]s -f - -C %[1]s", shellQuote(dir), decompress, flags)
+	c.log.Debug("running tar", slog.String("cmd", cmd))
+
+	err = c.exchange(ctx, cmd, func(stdin io.Writer, _ io.Reader) (err error) {
+		wire := &meter{ctx: ctx, limits: c.mgr.limiters(options.RateLimit)}
+		cw, err := compressWriter(ctx, wire.writer(stdin), options.Compression)
+		if err != nil {
+			return err
+		}
+
+		tw := tar.NewWriter(cw)
+		files := &meter{ctx: ctx, progress: progress}
+		if err = writeTar(tw, tree, files, options.TransferOptions); err == nil {
+			err = tw.Close()
+		}
+
+		if cerr := cw.Close(); err == nil {
+			err = cerr
+		}
+		return err
+	})
+	if err != nil || !options.Verify {
+		return err
+	}
+	return c.verify(ctx, files, true)
+}
+
+// writeTar writes the tree entries to tw in path order, so directories precede their contents
+func writeTar(tw *tar.Writer, tree map[string]treeEntry, files *meter, options TransferOptions) (err error) {
+	for _, rel := range sortedKeys(tree) {
+		e := tree[rel]
+		hdr, err := tar.FileInfoHeader(e.info, e.target)
+		if err != nil {
+			return fmt.Errorf("%s: %w", e.path, err)
+		}
+
+		hdr.Name = rel
+		hdr.Uid, hdr.Gid, hdr.Uname, hdr.Gname = 0, 0, "", ""
+
+		switch {
+		case e.target != "":
+			hdr.Typeflag, hdr.Linkname = tar.TypeSymlink, e.target
+		case e.info.IsDir():
+			hdr.Typeflag, hdr.Name = tar.TypeDir, rel+"/"
+			if !options.PreservePermissions {
+				hdr.Mode = 0755
+			}
+		default:
+			// Followed links are archived as the files they point to
+			hdr.Typeflag = tar.TypeReg
+			if !options.PreservePermissions {
+				hdr.Mode = 0644
+			}
+		}
+
+		if err = tw.WriteHeader(hdr); err != nil {
+			return err
+		}
+
+		if hdr.Typeflag != tar.TypeReg {
+			continue
+		}
+
+		if err = writeTarFile(tw, e.path, hdr.Size, files); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func writeTarFile(tw *tar.Writer, name string, size int64, files *meter) (err error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	files.path = name
+	n, err := io.Copy(tw, files.reader(io.LimitReader(f, size)))
+	if err == nil && n != size {
+		err = fmt.Errorf("%s: file changed size during transfer", name)
+	}
+	return err
+}
+
+// TarDownload copies the remote file or directory tree at remote to local as a single
+// tar stream created by tar on the remote host, avoiding the per file round trips
+// of SFTPClient.Download whose semantics it otherwise follows. Filters are applied
+// locally, so excluded files are still streamed
+func (c *Client) TarDownload(ctx context.Context, remote, local string, options TarOptions) (err error) {
+	ctx, span := c.tracer.Start(ctx, "sshmgr.tar.download", c.attrs...)
+	defer func() { endSpan(span, err) }()
+
+	if err = options.Compression.check(); err != nil {
+		return err
+	}
+
+	flags := ""
+	if options.Symlinks == SymlinkFollow {
+		flags = " -h"
+	}
+
+	top := path.Base(path.Clean(remote))
+	cmd := fmt.Sprintf("tar -c%s -f - -C %s -- %s", flags, shellQuote(path.Dir(path.Clean(remote))), shellQuote(top))
+
+	// Pipelines exit with the status of the compressor, so the tar exit status is
+	// reported on fd 3 and returned once the compressor succeeded
+	if compress, _ := options.Compression.remote(); compress != "" {
+		cmd = fmt.Sprintf(`exec 4>&1; s=$({ { %s; echo $? >&3; }%s >&4; } 3>&1) || exit; exit "$s"`, cmd, compress)
+	}
+	c.log.Debug("running tar", slog.String("cmd", cmd))
+
+	var received []string
+	err = c.exchange(ctx, cmd, func(_ io.Writer, stdout io.Reader) (err error) {
+		wire := &meter{ctx: ctx, limits: c.mgr.limiters(options.RateLimit)}
+		cr, err := decompressReader(ctx, wire.reader(stdout), options.Compression)
+		if err != nil {
+			return err
+		}
+
+		x := &tarExtract{root: local, top: top, log: c.log, options: options.TransferOptions,
+			files: &meter{ctx: ctx, progress: newProgressTracker(options.Progress, remote, 0)}}
+		if err = x.extract(tar.NewReader(cr)); err == nil {
+			// Drain the trailing padding so the remote commands complete
+			_, err = io.Copy(io.Discard, cr)
+		}
+		received = x.received
+
+		if cerr := cr.Close(); err == nil {
+			err = cerr
+		}
+		return err
+	})
+	if err != nil || !options.Verify {
+		return err
+	}
+	return c.verify(ctx, verifiedTree(local, remote, received), false)
+}
+
+// tarExtract extracts a tar stream with a single top level entry into root
+type tarExtract struct {
+	root     string
+	top      string
+	log      *slog.Logger
+	options  TransferOptions
+	files    *meter
+	skipped  []string
+	links    []string
+	dirs     []*tar.Header
+	received []string
+}
+
+func (x *tarExtract) extract(tr *tar.Reader) (err error) {
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+
+		rel, err := x.rel(hdr.Name)
+		if err != nil {
+			return err
+		}
+
+		dir := hdr.Typeflag == tar.TypeDir
+		if x.skip(rel, dir) {
+			if dir {
+				x.skipped = append(x.skipped, rel)
+			}
+			continue
+		}
+
+		target := filepath.Join(x.root, filepath.FromSlash(rel))
+		if err = x.entry(tr, hdr, rel, target); err != nil {
+			return fmt.Errorf("%s: %w", hdr.Name, err)
+		}
+	}
+
+	// Directory attributes are applied last, as creating files updates them
+	for i := len(x.dirs) - 1; i >= 0; i-- {
+		hdr := x.dirs[i]
+		if err = localAttributes(hdr.Name, hdr.FileInfo().Mode().Perm(), hdr.ModTime, x.options); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// entry extracts a single entry to target
+func (x *tarExtract) entry(tr *tar.Reader, hdr *tar.Header, rel, target string) (err error) {
+	switch hdr.Typeflag {
+	case tar.TypeDir:
+		if err = os.MkdirAll(target, 0755); err != nil {
+			return err
+		}
+		dir := *hdr
+		dir.Name = target
+		x.dirs = append(x.dirs, &dir)
+		return nil
+
+	case tar.TypeReg:
+		f, err := os.Create(target)
+		if err != nil {
+			return err
+		}
+
+		x.files.path = target
+		_, err = io.Copy(f, x.files.reader(tr))
+		if cerr := f.Close(); err == nil {
+			err = cerr
+		}
+		if err != nil {
+			return err
+		}
+		x.received = append(x.received, rel)
+		return localAttributes(target, hdr.FileInfo().Mode().Perm(), hdr.ModTime, x.options)
+
+	case tar.TypeSymlink:
+		if x.options.Symlinks != SymlinkCopy {
+			x.log.Debug("skipping symlink", slog.String("path", hdr.Name))
+			return nil
+		}
+		if info, err := os.Lstat(target); err == nil && info.Mode()&os.ModeSymlink != 0 {
+			if err = os.Remove(target); err != nil {
+				return err
+			}
+		}
+		x.links = append(x.links, rel)
+		return os.Symlink(hdr.Linkname, target)
+
+	case tar.TypeLink:
+		linked, err := x.rel(hdr.Linkname)
+		if err != nil {
+			return err
+		}
+		if x.skip(linked, false) {
+			return nil
+		}
+		os.Remove(target)
+		return os.Link(filepath.Join(x.root, filepath.FromSlash(linked)), target)
+
+	default:
+		x.log.Debug("skipping special file", slog.String("path", hdr.Name))
+		return nil
+	}
+}
+
+// rel returns the path of name relative to the top level entry, rejecting names escaping it
+func (x *tarExtract) rel(name string) (rel string, err error) {
+	name = path.Clean(name)
+	switch {
+	case name == x.top:
+		return "", nil
+	case x.top == "." || x.top == "/":
+		rel = strings.TrimPrefix(name, "/")
+	case strings.HasPrefix(name, x.top+"/"):
+		rel = name[len(x.top)+1:]
+	default:
+		return "", fmt.Errorf("tar: unexpected entry %q", name)
+	}
+
+	if !fs.ValidPath(rel) {
+		return "", fmt.Errorf("tar: invalid entry %q", name)
+	}
+	return rel, nil
+}
+
+// skip reports whether rel is filtered out, is under a skipped directory,
+// or would be written through an extracted symbolic link
+func (x *tarExtract) skip(rel string, dir bool) (skip bool) {
+	if rel == "" {
+		return false
+	}
+
+	for _, prefix := range append(x.skipped, x.links...) {
+		if strings.HasPrefix(rel, prefix+"/") {
+			return true
+		}
+	}
+	return !x.options.match(rel, dir)
+}
+
+// compressWriter returns a writer compressing to w, which must be closed to flush the stream
+func compressWriter(ctx context.Context, w io.Writer, compression TarCompression) (wc io.WriteCloser, err error) {
+	switch compression {
+	case TarGzip:
+		return gzip.NewWriter(w), nil
+	case TarZstd:
+		cmd := exec.CommandContext(ctx, "zstd", "-q", "-c")
+		cmd.Stdout = w
+		in, err := cmd.StdinPipe()
+		if err != nil {
+			return nil, err
+		}
+		if err = cmd.Start(); err != nil {
+			return nil, err
+		}
+		return &cmdWriter{WriteCloser: in, cmd: cmd}, nil
+	default:
+		return nopWriteCloser{w}, nil
+	}
+}
+
+// decompressReader returns a reader decompressing r, which must be closed to release it
+func decompressReader(ctx context.Context, r io.Reader, compression TarCompression) (rc io.ReadCloser, err error) {
+	switch compression {
+	case TarGzip:
+		return gzip.NewReader(r)
+	case TarZstd:
+		ctx, cancel := context.WithCancel(ctx)
+		cmd := exec.CommandContext(ctx, "zstd", "-q", "-dc")
+		cmd.Stdin = r
+		out, err := cmd.StdoutPipe()
+		if err == nil {
+			err = cmd.Start()
+		}
+		if err != nil {
+			cancel()
+			return nil, err
+		}
+		return &cmdReader{ReadCloser: out, cmd: cmd, cancel: cancel}, nil
+	default:
+		return io.NopCloser(r), nil
+	}
+}
+
+// cmdWriter writes to a local command, waiting for it on Close
+type cmdWriter struct {
+	io.WriteCloser
+	cmd *exec.Cmd
+}
+
+func (w *cmdWriter) Close() (err error) {
+	err = w.WriteCloser.Close()
+	if werr := w.cmd.Wait(); err == nil {
+		err = werr
+	}
+	return err
+}
+
+// cmdReader reads from a local command. Close waits for the command if its
+// output was read to the end, and kills it otherwise
+type cmdReader struct {
+	io.ReadCloser
+	cmd    *exec.Cmd
+	cancel context.CancelFunc
+	eof    bool
+}
+
+func (r *cmdReader) Read(p []byte) (n int, err error) {
+	n, err = r.ReadCloser.Read(p)
+	r.eof = r.eof || errors.Is(err, io.EOF)
+	return n, err
+}
+
+func (r *cmdReader) Close() (err error) {
+	if !r.eof {
+		r.cancel()
+	}
+	err = r.cmd.Wait()
+	r.cancel()
+	if !r.eof {
+		return nil
+	}
+	return err
+}
+
+type nopWriteCloser struct {
+	io.Writer
+}
+
+func (nopWriteCloser) Close() error { return nil }
@@ -0,0 +1,144 @@
+package sshmgr
+
+import (
+	"context"
+	"errors"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestTarTransfer(t *testing.T) {
+	server := newTestServer(t)
+	manager := New(time.Minute, time.Minute)
+	defer manager.Close()
+
+	client, err := manager.SSHClient(server.clientConfig())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	src := t.TempDir()
+	writeTree(t, src, map[string]string{
+		"a.txt":          "a",
+		"b.log":          "b",
+		"sub/c.txt":      "c",
+		"sub/deep/d.txt": "d",
+		"tmp/e.txt":      "e",
+		"logs/f.log":     "f",
+	})
+	if err = os.Symlink("a.txt", filepath.Join(src, "link.txt")); err != nil {
+		t.Fatal(err)
+	}
+
+	mtime := time.Now().Add(-time.Hour).Truncate(time.Second)
+	if err = os.Chtimes(filepath.Join(src, "sub", "c.txt"), mtime, mtime); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, compression := range []TarCompression{TarUncompressed, TarGzip, TarZstd} {
+		if _, err = exec.LookPath("zstd"); err != nil && compression == TarZstd {
+			continue
+		}
+
+		ctx := context.Background()
+		remote := filepath.Join(t.TempDir(), "remote")
+		options := TarOptions{
+			TransferOptions: TransferOptions{
+				PreservePermissions: true,
+				PreserveTimes:       true,
+				Symlinks:            SymlinkCopy,
+				Include:             []string{"*.txt"},
+				Exclude:             []string{"tmp"},
+				Verify:              true,
+			},
+			Compression: compression,
+		}
+
+		if err = client.TarUpload(ctx, src, remote, options); err != nil {
+			t.Fatal(err)
+		}
+
+		expected := map[string]string{
+			"a.txt":          "a",
+			"sub/c.txt":      "c",
+			"sub/deep/d.txt": "d",
+			"link.txt":       "-> a.txt",
+		}
+		assertTree(t, remote, expected)
+
+		// Directories without included files are not created
+		if _, err = os.Stat(filepath.Join(remote, "logs")); !os.IsNotExist(err) {
+			t.Fatalf("expected logs not to be created, got: %v", err)
+		}
+
+		info, err := os.Stat(filepath.Join(remote, "sub", "c.txt"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if info.Mode().Perm() != 0640 || !info.ModTime().Equal(mtime) {
+			t.Fatalf("expected preserved attributes, got %s %s", info.Mode(), info.ModTime())
+		}
+
+		var last TransferProgress
+		local := filepath.Join(t.TempDir(), "local")
+		options.Exclude = []string{"deep"}
+		options.Progress = func(p TransferProgress) { last = p }
+		if err = client.TarDownload(ctx, remote, local, options); err != nil {
+			t.Fatal(err)
+		}
+		delete(expected, "sub/deep/d.txt")
+		assertTree(t, local, expected)
+
+		if last.Bytes != 2 {
+			t.Fatalf("expected 2 bytes of progress, got %+v", last)
+		}
+
+		// Single files are copied to the exact destination path
+		single := filepath.Join(t.TempDir(), "renamed.txt")
+		if err = client.TarDownload(ctx, filepath.Join(remote, "a.txt"), single, options); err != nil {
+			t.Fatal(err)
+		}
+		assertFile(t, single, []byte("a"))
+
+		// Tar failures are reported through the compressor
+		missing := filepath.Join(remote, "missing")
+		if err = client.TarDownload(ctx, missing, t.TempDir(), options); exitStatus(err) <= 0 {
+			t.Fatalf("expected download of a missing path to fail with compression %d, got %v", compression, err)
+		}
+	}
+}
+
+func TestTarZstdUnavailable(t *testing.T) {
+	server := newTestServer(t)
+	manager := New(time.Minute, time.Minute)
+	defer manager.Close()
+
+	client, err := manager.SSHClient(server.clientConfig())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	src := t.TempDir()
+	writeTree(t, src, map[string]string{"a.txt": "a"})
+	t.Setenv("PATH", t.TempDir())
+
+	// Missing local commands fail before running the remote commands
+	ctx := context.Background()
+	remote := filepath.Join(t.TempDir(), "remote")
+	options := TarOptions{Compression: TarZstd}
+	if err = client.TarUpload(ctx, src, remote, options); !errors.Is(err, ErrZstdUnavailable) {
+		t.Fatalf("expected zstd to be unavailable, got %v", err)
+	}
+	if _, err = os.Stat(remote); !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("expected the remote directory not to be created, got %v", err)
+	}
+
+	if err = client.TarDownload(ctx, src, t.TempDir(), options); !errors.Is(err, ErrZstdUnavailable) {
+		t.Fatalf("expected zstd to be unavailable, got %v", err)
+	}
+}
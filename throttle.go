@@ -0,0 +1,220 @@
+package sshmgr
+
+import (
+	"context"
+	"io"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/pkg/sftp"
+)
+
+// meterChunk bounds the bytes read or written at once by metered streams,
+// so limited streams progress smoothly and cancellation is checked often
+const meterChunk = 32 << 10
+
+// rateLimiter is a token bucket limiting the bandwidth of the streams sharing it
+type rateLimiter struct {
+	mtx    sync.Mutex
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+// newRateLimiter returns a limiter for bytesPerSecond allowing bursts of
+// a tenth of a second, or nil if bytesPerSecond is not positive
+func newRateLimiter(bytesPerSecond int64) (l *rateLimiter) {
+	if bytesPerSecond <= 0 {
+		return nil
+	}
+
+	rate := float64(bytesPerSecond)
+	burst := max(rate/10, meterChunk)
+	return &rateLimiter{rate: rate, burst: burst, tokens: burst, last: time.Now()}
+}
+
+// wait takes n tokens from the bucket, waiting until they are available or ctx is done.
+// Tokens are reserved before waiting so concurrent streams share the rate fairly
+func (l *rateLimiter) wait(ctx context.Context, n int) (err error) {
+	l.mtx.Lock()
+	now := time.Now()
+	l.tokens = min(l.burst, l.tokens+now.Sub(l.last).Seconds()*l.rate)
+	l.last = now
+	l.tokens -= float64(n)
+	delay := time.Duration(-l.tokens / l.rate * float64(time.Second))
+	l.mtx.Unlock()
+
+	if delay <= 0 {
+		return nil
+	}
+
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// limiters returns the limiter for a transfer limited to bytesPerSecond
+// along with the manager limiter, if set
+func (m *Manager) limiters(bytesPerSecond int64) (limits []*rateLimiter) {
+	if l := newRateLimiter(bytesPerSecond); l != nil {
+		limits = append(limits, l)
+	}
+	if m.rateLimit != nil {
+		limits = append(limits, m.rateLimit)
+	}
+	return limits
+}
+
+// progressTracker computes and reports the progress of a transfer,
+// serializing the calls to fn
+type progressTracker struct {
+	mtx   sync.Mutex
+	fn    func(TransferProgress)
+	state TransferProgress
+	start time.Time
+	base  int64
+}
+
+func newProgressTracker(fn func(TransferProgress), path string, total int64) (p *progressTracker) {
+	return &progressTracker{fn: fn, state: TransferProgress{Path: path, Total: total}, start: time.Now()}
+}
+
+// skip accounts bytes that are not transferred, like resumed chunks,
+// excluding them from the rate
+func (p *progressTracker) skip(n int64) {
+	p.mtx.Lock()
+	p.base += n
+	p.mtx.Unlock()
+	p.add("", n)
+}
+
+// grow increases the expected total of transfers discovering their files as they go
+func (p *progressTracker) grow(n int64) {
+	p.mtx.Lock()
+	p.state.Total += n
+	p.mtx.Unlock()
+}
+
+// add accounts n transferred bytes of the file at path, if not empty
+func (p *progressTracker) add(path string, n int64) {
+	if p == nil {
+		return
+	}
+
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+
+	p.state.Bytes += n
+	if path != "" {
+		p.state.Path = path
+	}
+
+	if elapsed := time.Since(p.start).Seconds(); elapsed > 0 {
+		p.state.Rate = float64(p.state.Bytes-p.base) / elapsed
+	}
+
+	p.state.ETA = 0
+	if p.state.Rate > 0 && p.state.Total > p.state.Bytes {
+		p.state.ETA = time.Duration(float64(p.state.Total-p.state.Bytes) / p.state.Rate * float64(time.Second))
+	}
+
+	if p.fn != nil {
+		p.fn(p.state)
+	}
+}
+
+// meter checks cancellation, limits bandwidth and reports progress of the streams it wraps
+type meter struct {
+	ctx      context.Context
+	limits   []*rateLimiter
+	progress *progressTracker
+	path     string
+	n        atomic.Int64
+}
+
+// account reports n transferred bytes and waits for their bandwidth
+func (m *meter) account(n int) (err error) {
+	if n <= 0 {
+		return nil
+	}
+
+	m.n.Add(int64(n))
+	m.progress.add(m.path, int64(n))
+	for _, l := range m.limits {
+		if err = l.wait(m.ctx, n); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// copy copies src to dst through the meter. The metering is done on the local side,
+// so the concurrent reads and writes of sftp.File WriteTo and ReadFrom are kept
+func (m *meter) copy(dst io.Writer, src io.Reader) (n int64, err error) {
+	if _, ok := src.(*sftp.File); ok {
+		return io.Copy(m.writer(dst), src)
+	}
+	return io.Copy(dst, m.reader(src))
+}
+
+func (m *meter) reader(r io.Reader) (mr io.Reader) {
+	return &meteredReader{m: m, r: r}
+}
+
+func (m *meter) writer(w io.Writer) (mw io.Writer) {
+	return &meteredWriter{m: m, w: w}
+}
+
+type meteredReader struct {
+	m *meter
+	r io.Reader
+}
+
+func (r *meteredReader) Read(p []byte) (n int, err error) {
+	if err = r.m.ctx.Err(); err != nil {
+		return 0, err
+	}
+
+	if len(p) > meterChunk {
+		p = p[:meterChunk]
+	}
+
+	n, err = r.r.Read(p)
+	if aerr := r.m.account(n); err == nil {
+		err = aerr
+	}
+	return n, err
+}
+
+type meteredWriter struct {
+	m *meter
+	w io.Writer
+}
+
+func (w *meteredWriter) Write(p []byte) (n int, err error) {
+	for len(p) > 0 {
+		if err = w.m.ctx.Err(); err != nil {
+			return n, err
+		}
+
+		var nw int
+		nw, err = w.w.Write(p[:min(len(p), meterChunk)])
+		n += nw
+		if aerr := w.m.account(nw); err == nil {
+			err = aerr
+		}
+		if err != nil {
+			return n, err
+		}
+		p = p[nw:]
+	}
+	return n, nil
+}
@@ -0,0 +1,133 @@
+package sshmgr
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"io"
+	"testing"
+	"time"
+)
+
+func TestStreamRateLimit(t *testing.T) {
+	server := newTestServer(t)
+	manager := New(time.Minute, time.Minute, WithRateLimit(256<<10))
+	defer manager.Close()
+
+	client, err := manager.SSHClient(server.clientConfig())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	data := make([]byte, 64<<10)
+	rand.Read(data)
+
+	var stdout bytes.Buffer
+	var last TransferProgress
+	options := StreamOptions{
+		Stdin:    bytes.NewReader(data),
+		Stdout:   &stdout,
+		Progress: func(p TransferProgress) { last = p },
+	}
+
+	start := time.Now()
+	if err = client.Stream(context.Background(), "cat", options); err != nil {
+		t.Fatal(err)
+	}
+	elapsed := time.Since(start)
+
+	if !bytes.Equal(stdout.Bytes(), data) {
+		t.Fatalf("expected %d echoed bytes, got %d", len(data), stdout.Len())
+	}
+
+	// 128KiB through the shared 256KiB/s bucket, less the 32KiB burst
+	if elapsed < 300*time.Millisecond {
+		t.Fatalf("stream was not throttled, took %s", elapsed)
+	}
+
+	if last.Bytes != 2*int64(len(data)) || last.Rate <= 0 {
+		t.Fatalf("unexpected final progress: %+v", last)
+	}
+}
+
+func TestRateLimiterCancel(t *testing.T) {
+	l := newRateLimiter(1 << 10)
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	if err := l.wait(ctx, 64<<10); err != context.DeadlineExceeded {
+		t.Fatalf("expected deadline exceeded, got %v", err)
+	}
+}
+
+func TestCombinedReaderRateLimit(t *testing.T) {
+	server := newTestServer(t)
+	manager := New(time.Minute, time.Minute, WithRateLimit(4<<20))
+	defer manager.Close()
+
+	client, err := manager.SSHClient(server.clientConfig())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	// Output larger than the channel window is streamed while the command runs
+	start := time.Now()
+	r, err := client.CombinedReader("head -c 3145728 /dev/zero; echo done >&2", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := io.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = r.Close(); err != nil {
+		t.Fatal(err)
+	}
+	elapsed := time.Since(start)
+
+	if len(data) != 3<<20+len("done\n") || !bytes.Contains(data, []byte("done\n")) {
+		t.Fatalf("expected 3MiB of output and stderr, got %d bytes", len(data))
+	}
+
+	// 3MiB through the 4MiB/s bucket, less the 0.4MiB burst
+	if elapsed < 600*time.Millisecond {
+		t.Fatalf("output was not throttled, took %s", elapsed)
+	}
+
+	// The command error is returned on close
+	if r, err = client.CombinedReader("echo failed; exit 3", nil); err != nil {
+		t.Fatal(err)
+	}
+	if data, _ = io.ReadAll(r); string(data) != "failed\n" {
+		t.Fatalf("unexpected output %q", data)
+	}
+	if err = r.Close(); exitStatus(err) != 3 {
+		t.Fatalf("expected exit status 3, got: %v", err)
+	}
+
+	// Closing before the end of the output kills the command
+	if r, err = client.CombinedReader("cat /dev/zero", nil); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = io.ReadFull(r, make([]byte, 1024)); err != nil {
+		t.Fatal(err)
+	}
+
+	closed := make(chan error)
+	go func() { closed <- r.Close() }()
+	select {
+	case err = <-closed:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(3 * time.Second):
+		t.Fatal("close blocked on a command with unread output")
+	}
+
+	if stats := manager.Stats(); stats.Sessions != 0 {
+		t.Fatalf("expected sessions to be closed, got: %+v", stats)
+	}
+}
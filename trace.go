@@ -0,0 +1,70 @@
+package sshmgr
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// Tracer starts spans around manager and client operations.
+// It mirrors the OpenTelemetry trace.Tracer so an adapter is a thin wrapper
+// converting the slog.Attr attributes to attribute.KeyValue
+type Tracer interface {
+	Start(ctx context.Context, name string, attrs ...slog.Attr) (context.Context, Span)
+}
+
+// Span is a traced operation started by a Tracer
+type Span interface {
+	// SetAttributes adds attributes to the span
+	SetAttributes(attrs ...slog.Attr)
+	// RecordError records err on the span and marks it as failed
+	RecordError(err error)
+	// End completes the span
+	End()
+}
+
+// noopTracer is the default tracer, it creates no spans
+type noopTracer struct{}
+
+func (noopTracer) Start(ctx context.Context, name string, attrs ...slog.Attr) (context.Context, Span) {
+	return ctx, noopSpan{}
+}
+
+type noopSpan struct{}
+
+func (noopSpan) SetAttributes(attrs ...slog.Attr) {}
+func (noopSpan) RecordError(err error)            {}
+func (noopSpan) End()                             {}
+
+// endSpan records err if not nil and ends the span
+func endSpan(span Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+	}
+	span.End()
+}
+
+// configAttrs returns the span attributes identifying the host and user of config
+func configAttrs(config ClientConfig) (attrs []slog.Attr) {
+	return []slog.Attr{
+		slog.String("host", config.NetAddr),
+		slog.String("port", config.Port),
+		slog.String("user", config.User),
+	}
+}
+
+// exitStatus returns the remote exit status from a command error
+// or -1 if the command did not exit with a status
+func exitStatus(err error) (status int) {
+	if err == nil {
+		return 0
+	}
+
+	var exitErr *ssh.ExitError
+	if errors.As(err, &exitErr) {
+		return exitErr.ExitStatus()
+	}
+	return -1
+}
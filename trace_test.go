@@ -0,0 +1,161 @@
+package sshmgr
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+// recordingTracer records the spans it starts
+type recordingTracer struct {
+	mtx   sync.Mutex
+	spans []*recordedSpan
+}
+
+type recordedSpan struct {
+	mtx   sync.Mutex
+	name  string
+	attrs map[string]slog.Value
+	err   error
+	ended bool
+}
+
+func (t *recordingTracer) Start(ctx context.Context, name string, attrs ...slog.Attr) (context.Context, Span) {
+	span := &recordedSpan{name: name, attrs: map[string]slog.Value{}}
+	span.SetAttributes(attrs...)
+
+	t.mtx.Lock()
+	t.spans = append(t.spans, span)
+	t.mtx.Unlock()
+	return ctx, span
+}
+
+func (s *recordedSpan) SetAttributes(attrs ...slog.Attr) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	for _, attr := range attrs {
+		s.attrs[attr.Key] = attr.Value
+	}
+}
+
+func (s *recordedSpan) RecordError(err error) {
+	s.mtx.Lock()
+	s.err = err
+	s.mtx.Unlock()
+}
+
+func (s *recordedSpan) End() {
+	s.mtx.Lock()
+	s.ended = true
+	s.mtx.Unlock()
+}
+
+// last returns the last ended span with name
+func (t *recordingTracer) last(tb testing.TB, name string) (span *recordedSpan) {
+	tb.Helper()
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+
+	for i := len(t.spans) - 1; i >= 0; i-- {
+		if t.spans[i].name == name && t.spans[i].ended {
+			return t.spans[i]
+		}
+	}
+	tb.Fatalf("span %s not recorded", name)
+	return nil
+}
+
+// reset discards the recorded spans
+func (t *recordingTracer) reset() {
+	t.mtx.Lock()
+	t.spans = nil
+	t.mtx.Unlock()
+}
+
+func TestTracerSpans(t *testing.T) {
+	server := newTestServer(t)
+	tracer := &recordingTracer{}
+	manager := New(time.Minute, time.Minute, WithTracer(tracer))
+	defer manager.Close()
+
+	client, err := manager.SSHClient(server.clientConfig())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	dial := tracer.last(t, "sshmgr.dial")
+	if dial.err != nil || dial.attrs["user"].String() != "root" {
+		t.Fatalf("unexpected dial span: %+v", dial)
+	}
+
+	handshake := tracer.last(t, "sshmgr.handshake")
+	if handshake.err != nil || handshake.attrs["kex"].String() == "" || handshake.attrs["cipher"].String() == "" {
+		t.Fatalf("unexpected handshake span: %+v", handshake)
+	}
+
+	if span := tracer.last(t, "sshmgr.SSHClient"); span.err != nil || span.attrs["reused"].Bool() {
+		t.Fatalf("unexpected client span: %+v", span)
+	}
+
+	// Commands record their exit status and failures
+	if _, err = client.CombinedOutput("printf abc", nil); err != nil {
+		t.Fatal(err)
+	}
+	exec := tracer.last(t, "sshmgr.exec")
+	if exec.err != nil || exec.attrs["exit_status"].Int64() != 0 || exec.attrs["bytes"].Int64() != 3 {
+		t.Fatalf("unexpected exec span: %+v", exec)
+	}
+
+	_, err = client.CombinedOutput("exit 3", nil)
+	if err == nil {
+		t.Fatal("expected command to fail")
+	}
+	exec = tracer.last(t, "sshmgr.exec")
+	if exec.err == nil || exec.attrs["exit_status"].Int64() != 3 {
+		t.Fatalf("unexpected exec span: %+v", exec)
+	}
+
+	// Exit statuses are found in wrapped errors
+	if status := exitStatus(fmt.Errorf("running: %w", err)); status != 3 {
+		t.Fatalf("expected exit status 3 from wrapped error, got %d", status)
+	}
+
+	// Handshake failures are recorded on the handshake span
+	tracer.reset()
+	config := server.clientConfig()
+	config.Password = "wrong"
+	if _, err = manager.SSHClient(config); err == nil {
+		t.Fatal("expected authentication to fail")
+	}
+	if span := tracer.last(t, "sshmgr.handshake"); span.err == nil {
+		t.Fatal("expected handshake span to record the error")
+	}
+	if span := tracer.last(t, "sshmgr.dial"); span.err != nil {
+		t.Fatalf("unexpected dial error: %v", span.err)
+	}
+
+	// Dial failures are recorded on the dial span
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	l.Close()
+
+	tracer.reset()
+	config = server.clientConfig()
+	config.NetAddr = l.Addr().String()
+	if _, err = manager.SSHClient(config); err == nil {
+		t.Fatal("expected dial to fail")
+	}
+	if span := tracer.last(t, "sshmgr.dial"); span.err == nil {
+		t.Fatal("expected dial span to record the error")
+	}
+	if span := tracer.last(t, "sshmgr.SSHClient"); span.err == nil {
+		t.Fatal("expected client span to record the error")
+	}
+}
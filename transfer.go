@@ -0,0 +1,574 @@
+package sshmgr
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/sftp"
+)
+
+// defaultTransferWorkers is the number of files transferred concurrently
+// when no worker count is configured
+const defaultTransferWorkers = 4
+
+// maxSymlinkDepth bounds the number of followed directory symlinks in a path,
+// preventing endless walks on symlink loops
+const maxSymlinkDepth = 40
+
+// SymlinkPolicy controls how symbolic links are handled in transfers
+type SymlinkPolicy int
+
+const (
+	// SymlinkSkip ignores symbolic links
+	SymlinkSkip SymlinkPolicy = iota
+	// SymlinkFollow transfers the files and directories links point to
+	SymlinkFollow
+	// SymlinkCopy recreates links with the same target on the destination
+	SymlinkCopy
+)
+
+// TransferOptions configures recursive transfers
+type TransferOptions struct {
+	// PreservePermissions applies the source permission bits to the destination
+	PreservePermissions bool
+
+	// PreserveTimes applies the source modification times to the destination
+	PreserveTimes bool
+
+	// Symlinks is the symbolic link policy, links are skipped by default
+	Symlinks SymlinkPolicy
+
+	// Include transfers only files matching any of these patterns if not empty.
+	// Patterns use the path.Match syntax and are matched against the file base name,
+	// or against the slash separated path relative to the source root if they
+	// contain a slash. Directories are always walked unless excluded, but
+	// are only created at the destination when they hold transferred files
+	Include []string
+
+	// Exclude skips files and directories matching any of these patterns
+	Exclude []string
+
+	// Workers is the number of files transferred concurrently, defaults to 4
+	Workers int
+
+	// RateLimit bounds the bandwidth of the transfer in bytes per second,
+	// in addition to the manager limit set with WithRateLimit. Unlimited if zero
+	RateLimit int64
+
+	// Progress is called as data is transferred, calls are serialized.
+	// The total grows as files are found while walking the source tree
+	Progress func(progress TransferProgress)
+
+	// SCPFallback makes Manager.Upload and Manager.Download transfer with scp
+	// on hosts without a sftp subsystem
+	SCPFallback bool
+
+	// Verify compares the sha256 checksums of the transferred files with their
+	// sources once the transfer completes, failing with a *ChecksumMismatchError
+	// if they differ. Remote checksums are computed on the remote host
+	Verify bool
+}
+
+// match reports whether the relative path rel should be transferred
+func (o TransferOptions) match(rel string, dir bool) (ok bool) {
+	if matchAny(o.Exclude, rel) {
+		return false
+	}
+	return dir || len(o.Include) == 0 || matchAny(o.Include, rel)
+}
+
+func matchAny(patterns []string, rel string) (ok bool) {
+	for _, pattern := range patterns {
+		name := path.Base(rel)
+		if strings.Contains(pattern, "/") {
+			name = rel
+		}
+		if ok, _ = path.Match(pattern, name); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// Upload copies the local file or directory tree at local to remote.
+// Directories are copied recursively into remote, which is created if needed
+func (s *SFTPClient) Upload(ctx context.Context, local, remote string, options TransferOptions) (err error) {
+	ctx, span := s.client.tracer.Start(ctx, "sshmgr.sftp.upload", s.client.attrs...)
+	defer func() { endSpan(span, err) }()
+
+	copied, err := transferTree(ctx, s.client.log, localFS{}, &remoteFS{s}, local, remote, s.client.mgr.limiters(options.RateLimit), options)
+	if err != nil || !options.Verify {
+		return err
+	}
+	return s.client.verify(ctx, verifiedFiles(copied, true), true)
+}
+
+// Download copies the remote file or directory tree at remote to local.
+// Directories are copied recursively into local, which is created if needed
+func (s *SFTPClient) Download(ctx context.Context, remote, local string, options TransferOptions) (err error) {
+	ctx, span := s.client.tracer.Start(ctx, "sshmgr.sftp.download", s.client.attrs...)
+	defer func() { endSpan(span, err) }()
+
+	copied, err := transferTree(ctx, s.client.log, &remoteFS{s}, localFS{}, remote, local, s.client.mgr.limiters(options.RateLimit), options)
+	if err != nil || !options.Verify {
+		return err
+	}
+	return s.client.verify(ctx, verifiedFiles(copied, false), false)
+}
+
+// Upload copies the local file or directory tree at local to remote on the host
+// of config with a pooled sftp session, see SFTPClient.Upload. With the SCPFallback
+// option scp is used instead on hosts without a sftp subsystem, see Client.SCPUpload
+func (m *Manager) Upload(ctx context.Context, config ClientConfig, local, remote string, options TransferOptions) (err error) {
+	return m.transfer(ctx, config, options,
+		func(s *SFTPClient) error { return s.Upload(ctx, local, remote, options) },
+		func(c *Client) error { return c.SCPUpload(ctx, local, remote, options) })
+}
+
+// Download copies the remote file or directory tree at remote on the host of config
+// to local with a pooled sftp session, see SFTPClient.Download. With the SCPFallback
+// option scp is used instead on hosts without a sftp subsystem, see Client.SCPDownload
+func (m *Manager) Download(ctx context.Context, config ClientConfig, remote, local string, options TransferOptions) (err error) {
+	return m.transfer(ctx, config, options,
+		func(s *SFTPClient) error { return s.Download(ctx, remote, local, options) },
+		func(c *Client) error { return c.SCPDownload(ctx, remote, local, options) })
+}
+
+// transfer runs viaSFTP with a sftp session for config, or viaSCP with a client
+// if the sftp subsystem is unavailable and scp fallback is enabled
+func (m *Manager) transfer(ctx context.Context, config ClientConfig, options TransferOptions,
+	viaSFTP func(s *SFTPClient) error, viaSCP func(c *Client) error) (err error) {
+
+	session, err := m.SFTPClientContext(ctx, config)
+	if err == nil {
+		defer session.Close()
+		return viaSFTP(session)
+	}
+
+	if !options.SCPFallback || !errors.Is(err, ErrSFTPUnavailable) {
+		return err
+	}
+
+	client, err := m.SSHClientContext(ctx, config)
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+
+	client.log.Info("sftp subsystem unavailable, falling back to scp")
+	return viaSCP(client)
+}
+
+// transferFS is the file system abstraction transfers are made between
+type transferFS interface {
+	Stat(name string) (os.FileInfo, error)
+	Lstat(name string) (os.FileInfo, error)
+	ReadDir(name string) ([]os.FileInfo, error)
+	ReadLink(name string) (string, error)
+	Open(name string) (io.ReadCloser, error)
+	Create(name string) (io.WriteCloser, error)
+	MkdirAll(name string) error
+	Symlink(target, name string) error
+	Remove(name string) error
+	Chmod(name string, mode os.FileMode) error
+	Chtimes(name string, atime, mtime time.Time) error
+	Join(elem ...string) string
+}
+
+// localFS is the local file system
+type localFS struct{}
+
+func (localFS) Stat(name string) (os.FileInfo, error)  { return os.Stat(name) }
+func (localFS) Lstat(name string) (os.FileInfo, error) { return os.Lstat(name) }
+func (localFS) ReadLink(name string) (string, error)   { return os.Readlink(name) }
+func (localFS) Open(name string) (io.ReadCloser, error) {
+	return os.Open(name)
+}
+func (localFS) Create(name string) (io.WriteCloser, error) {
+	return os.Create(name)
+}
+func (localFS) MkdirAll(name string) error                { return os.MkdirAll(name, 0755) }
+func (localFS) Symlink(target, name string) error         { return os.Symlink(target, name) }
+func (localFS) Remove(name string) error                  { return os.Remove(name) }
+func (localFS) Chmod(name string, mode os.FileMode) error { return os.Chmod(name, mode) }
+func (localFS) Chtimes(name string, atime, mtime time.Time) error {
+	return os.Chtimes(name, atime, mtime)
+}
+func (localFS) Join(elem ...string) string { return filepath.Join(elem...) }
+
+func (localFS) ReadDir(name string) (infos []os.FileInfo, err error) {
+	entries, err := os.ReadDir(name)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, entry := range entries {
+		info, err := entry.Info()
+		if err != nil {
+			return nil, err
+		}
+		infos = append(infos, info)
+	}
+	return infos, nil
+}
+
+// remoteFS is the remote file system of a sftp session
+type remoteFS struct {
+	s *SFTPClient
+}
+
+func (r *remoteFS) Stat(name string) (os.FileInfo, error)      { return r.s.Stat(name) }
+func (r *remoteFS) Lstat(name string) (os.FileInfo, error)     { return r.s.Lstat(name) }
+func (r *remoteFS) ReadDir(name string) ([]os.FileInfo, error) { return r.s.ReadDir(name) }
+func (r *remoteFS) ReadLink(name string) (string, error)       { return r.s.ReadLink(name) }
+func (r *remoteFS) Join(elem ...string) string                 { return path.Join(elem...) }
+
+func (r *remoteFS) Open(name string) (rc io.ReadCloser, err error) {
+	return r.s.Open(name)
+}
+
+func (r *remoteFS) Create(name string) (wc io.WriteCloser, err error) {
+	err = r.do(func(client *sftp.Client) (err error) {
+		wc, err = client.Create(name)
+		return err
+	})
+	return wc, err
+}
+
+func (r *remoteFS) MkdirAll(name string) (err error) {
+	return r.do(func(client *sftp.Client) error { return client.MkdirAll(name) })
+}
+
+func (r *remoteFS) Symlink(target, name string) (err error) {
+	return r.do(func(client *sftp.Client) error { return client.Symlink(target, name) })
+}
+
+func (r *remoteFS) Remove(name string) (err error) {
+	return r.do(func(client *sftp.Client) error { return client.Remove(name) })
+}
+
+func (r *remoteFS) Chmod(name string, mode os.FileMode) (err error) {
+	return r.do(func(client *sftp.Client) error { return client.Chmod(name, mode) })
+}
+
+func (r *remoteFS) Chtimes(name string, atime, mtime time.Time) (err error) {
+	return r.do(func(client *sftp.Client) error { return client.Chtimes(name, atime, mtime) })
+}
+
+// do runs fn with the current session without retries, as writes are not idempotent
+func (r *remoteFS) do(fn func(client *sftp.Client) error) (err error) {
+	return r.s.do(fn)
+}
+
+// transferJob is a file to be copied by the transfer workers
+type transferJob struct {
+	src, dst string
+	info     os.FileInfo
+}
+
+// transferDir is a destination directory found while walking the source,
+// created with its parents before the first entry is placed under it
+type transferDir struct {
+	parent  *transferDir
+	job     transferJob
+	created bool
+}
+
+// transfer copies a tree between file systems
+type transfer struct {
+	parent  context.Context
+	ctx     context.Context
+	cancel  context.CancelFunc
+	wg      sync.WaitGroup
+	log     *slog.Logger
+	src     transferFS
+	dst     transferFS
+	options TransferOptions
+	limits  []*rateLimiter
+	stats   *progressTracker
+	jobs    chan transferJob
+	dirs    []transferJob
+	mtx     sync.Mutex
+	copied  []transferJob
+	once    sync.Once
+	err     error
+}
+
+// transferTree copies the file or directory tree at srcRoot to dstRoot,
+// returning the copied files if they are to be verified
+func transferTree(ctx context.Context, log *slog.Logger, src, dst transferFS,
+	srcRoot, dstRoot string, limits []*rateLimiter, options TransferOptions) (copied []transferJob, err error) {
+
+	info, err := src.Stat(srcRoot)
+	if err != nil {
+		return nil, err
+	}
+
+	t := newTransfer(ctx, log, src, dst, srcRoot, limits, options)
+	if info.IsDir() {
+		t.walk(nil, transferJob{src: srcRoot, dst: dstRoot, info: info}, "", 0)
+	} else {
+		t.queue(transferJob{src: srcRoot, dst: dstRoot, info: info})
+	}
+
+	err = t.wait()
+	return t.copied, err
+}
+
+// newTransfer starts the transfer workers, files are queued with queue
+// and wait must be called once all files are queued
+func newTransfer(ctx context.Context, log *slog.Logger, src, dst transferFS, srcRoot string,
+	limits []*rateLimiter, options TransferOptions) (t *transfer) {
+
+	workers := options.Workers
+	if workers <= 0 {
+		workers = defaultTransferWorkers
+	}
+
+	t = &transfer{log: log, src: src, dst: dst, options: options, limits: limits, jobs: make(chan transferJob)}
+	t.stats = newProgressTracker(options.Progress, srcRoot, 0)
+	t.parent = ctx
+	t.ctx, t.cancel = context.WithCancel(ctx)
+
+	for i := 0; i < workers; i++ {
+		t.wg.Add(1)
+		go func() {
+			defer t.wg.Done()
+			for job := range t.jobs {
+				if err := t.copyFile(job); err != nil {
+					t.fail(fmt.Errorf("%s: %w", job.src, err))
+				}
+			}
+		}()
+	}
+	return t
+}
+
+// wait for the queued files and apply the directory attributes
+func (t *transfer) wait() (err error) {
+	defer t.cancel()
+	close(t.jobs)
+	t.wg.Wait()
+
+	// Directory times are applied last, as creating files updates them
+	for i := len(t.dirs) - 1; i >= 0 && t.err == nil; i-- {
+		if err = t.attributes(t.dirs[i]); err != nil {
+			t.fail(err)
+		}
+	}
+
+	if t.err == nil {
+		t.err = t.parent.Err()
+	}
+	return t.err
+}
+
+// fail records the first error and stops the transfer
+func (t *transfer) fail(err error) {
+	t.once.Do(func() {
+		t.err = err
+		t.cancel()
+	})
+}
+
+func (t *transfer) queue(job transferJob) {
+	t.stats.grow(job.info.Size())
+	select {
+	case t.jobs <- job:
+	case <-t.ctx.Done():
+	}
+}
+
+// mkdir creates the destination directory of d and its parents if not yet created.
+// Directories are only created by the walking goroutine
+func (t *transfer) mkdir(d *transferDir) (err error) {
+	if d == nil || d.created {
+		return nil
+	}
+
+	if err = t.mkdir(d.parent); err != nil {
+		return err
+	}
+
+	if err = t.dst.MkdirAll(d.job.dst); err != nil {
+		return fmt.Errorf("%s: %w", d.job.dst, err)
+	}
+	d.created = true
+	t.dirs = append(t.dirs, d.job)
+	return nil
+}
+
+// walk queues the contents of the directory job under parent. The destination
+// directory is created once an entry is placed under it when files are selected
+// with Include patterns, otherwise the source tree is mirrored including empty
+// directories. The root directory is always created
+func (t *transfer) walk(parent *transferDir, job transferJob, rel string, links int) {
+	if t.ctx.Err() != nil {
+		return
+	}
+
+	dir := &transferDir{parent: parent, job: job}
+	if parent == nil || len(t.options.Include) == 0 {
+		if err := t.mkdir(dir); err != nil {
+			t.fail(err)
+			return
+		}
+	}
+
+	src, dst := job.src, job.dst
+	entries, err := t.src.ReadDir(src)
+	if err != nil {
+		t.fail(fmt.Errorf("%s: %w", src, err))
+		return
+	}
+
+	for _, entry := range entries {
+		if t.ctx.Err() != nil {
+			return
+		}
+
+		name := entry.Name()
+		job := transferJob{src: t.src.Join(src, name), dst: t.dst.Join(dst, name), info: entry}
+		erel := path.Join(rel, name)
+		elinks := links
+
+		if entry.Mode()&os.ModeSymlink != 0 {
+			switch t.options.Symlinks {
+			case SymlinkCopy:
+				if t.options.match(erel, false) {
+					if err = t.mkdir(dir); err != nil {
+						t.fail(err)
+						return
+					}
+					if err = t.copyLink(job); err != nil {
+						t.fail(fmt.Errorf("%s: %w", job.src, err))
+						return
+					}
+				}
+				continue
+
+			case SymlinkFollow:
+				if job.info, err = t.src.Stat(job.src); err != nil {
+					t.log.Warn("skipping broken symlink", slog.String("path", job.src), slog.Any("error", err))
+					continue
+				}
+				if elinks++; elinks > maxSymlinkDepth {
+					t.fail(fmt.Errorf("%s: too many levels of symbolic links", job.src))
+					return
+				}
+
+			default:
+				t.log.Debug("skipping symlink", slog.String("path", job.src))
+				continue
+			}
+		}
+
+		switch {
+		case job.info.IsDir():
+			if t.options.match(erel, true) {
+				t.walk(dir, job, erel, elinks)
+			}
+		case job.info.Mode().IsRegular():
+			if t.options.match(erel, false) {
+				if err = t.mkdir(dir); err != nil {
+					t.fail(err)
+					return
+				}
+				t.queue(job)
+			}
+		default:
+			t.log.Debug("skipping special file", slog.String("path", job.src))
+		}
+	}
+}
+
+// copyFile copies a regular file and its attributes
+func (t *transfer) copyFile(job transferJob) (err error) {
+	r, err := t.src.Open(job.src)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+
+	w, err := t.dst.Create(job.dst)
+	if err != nil {
+		return err
+	}
+
+	m := &meter{ctx: t.ctx, limits: t.limits, progress: t.stats, path: job.src}
+	if _, err = m.copy(w, r); err != nil {
+		w.Close()
+		return err
+	}
+
+	if err = w.Close(); err != nil {
+		return err
+	}
+
+	if err = t.attributes(job); err != nil {
+		return err
+	}
+
+	if t.options.Verify {
+		t.mtx.Lock()
+		t.copied = append(t.copied, job)
+		t.mtx.Unlock()
+	}
+	return nil
+}
+
+// copyLink recreates a symbolic link with the same target,
+// replacing an existing link at the destination
+func (t *transfer) copyLink(job transferJob) (err error) {
+	target, err := t.src.ReadLink(job.src)
+	if err != nil {
+		return err
+	}
+
+	if info, err := t.dst.Lstat(job.dst); err == nil && info.Mode()&os.ModeSymlink != 0 {
+		if err = t.dst.Remove(job.dst); err != nil {
+			return err
+		}
+	}
+	return t.dst.Symlink(target, job.dst)
+}
+
+// attributes applies the preserved permissions and times of job to its destination
+func (t *transfer) attributes(job transferJob) (err error) {
+	if t.options.PreservePermissions {
+		if err = t.dst.Chmod(job.dst, job.info.Mode().Perm()); err != nil {
+			return err
+		}
+	}
+
+	if t.options.PreserveTimes {
+		mtime := job.info.ModTime()
+		if err = t.dst.Chtimes(job.dst, mtime, mtime); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// localAttributes applies the preserved mode and modification time of a received local file
+func localAttributes(name string, mode os.FileMode, mtime time.Time, options TransferOptions) (err error) {
+	if options.PreservePermissions {
+		if err = os.Chmod(name, mode); err != nil {
+			return err
+		}
+	}
+
+	if options.PreserveTimes && !mtime.IsZero() {
+		return os.Chtimes(name, mtime, mtime)
+	}
+	return nil
+}
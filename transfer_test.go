@@ -0,0 +1,156 @@
+package sshmgr
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+	"time"
+)
+
+// writeTree creates files with the given contents under root
+func writeTree(t *testing.T, root string, files map[string]string) {
+	for name, data := range files {
+		p := filepath.Join(root, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(p, []byte(data), 0640); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// readTree returns the contents of the regular files and link targets under root
+func readTree(t *testing.T, root string) (files map[string]string) {
+	files = map[string]string{}
+	err := filepath.Walk(root, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, _ := filepath.Rel(root, p)
+		switch {
+		case info.Mode()&os.ModeSymlink != 0:
+			target, err := os.Readlink(p)
+			files[filepath.ToSlash(rel)] = "-> " + target
+			return err
+		case info.Mode().IsRegular():
+			data, err := os.ReadFile(p)
+			files[filepath.ToSlash(rel)] = string(data)
+			return err
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return files
+}
+
+func assertTree(t *testing.T, root string, expected map[string]string) {
+	files := readTree(t, root)
+	if len(files) != len(expected) {
+		var names []string
+		for name := range files {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		t.Fatalf("expected %d files, got: %v", len(expected), names)
+	}
+
+	for name, data := range expected {
+		if files[name] != data {
+			t.Fatalf("%s: expected %q, got: %q", name, data, files[name])
+		}
+	}
+}
+
+func TestUploadDownload(t *testing.T) {
+	server := newTestServer(t)
+	manager := New(time.Minute, time.Minute)
+	defer manager.Close()
+
+	session, err := manager.SFTPClient(server.clientConfig())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer session.Close()
+
+	src := t.TempDir()
+	writeTree(t, src, map[string]string{
+		"a.txt":          "a",
+		"b.log":          "b",
+		"sub/c.txt":      "c",
+		"sub/deep/d.txt": "d",
+		"tmp/e.txt":      "e",
+		"logs/f.log":     "f",
+		"logs/g/h.log":   "h",
+	})
+	if err = os.Symlink("a.txt", filepath.Join(src, "link.txt")); err != nil {
+		t.Fatal(err)
+	}
+
+	mtime := time.Now().Add(-time.Hour).Truncate(time.Second)
+	if err = os.Chtimes(filepath.Join(src, "sub", "c.txt"), mtime, mtime); err != nil {
+		t.Fatal(err)
+	}
+
+	remote := filepath.Join(t.TempDir(), "remote")
+	options := TransferOptions{
+		PreservePermissions: true,
+		PreserveTimes:       true,
+		Symlinks:            SymlinkCopy,
+		Include:             []string{"*.txt"},
+		Exclude:             []string{"tmp"},
+		Workers:             2,
+	}
+
+	if err = session.Upload(context.Background(), src, remote, options); err != nil {
+		t.Fatal(err)
+	}
+
+	// Repeated uploads overwrite files and links
+	if err = session.Upload(context.Background(), src, remote, options); err != nil {
+		t.Fatal(err)
+	}
+
+	assertTree(t, remote, map[string]string{
+		"a.txt":          "a",
+		"sub/c.txt":      "c",
+		"sub/deep/d.txt": "d",
+		"link.txt":       "-> a.txt",
+	})
+
+	// Directories without included files are not created
+	if _, err = os.Stat(filepath.Join(remote, "logs")); !os.IsNotExist(err) {
+		t.Fatalf("expected directory without included files not to be created, got: %v", err)
+	}
+
+	info, err := os.Stat(filepath.Join(remote, "sub", "c.txt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Mode().Perm() != 0640 || !info.ModTime().Equal(mtime) {
+		t.Fatalf("expected preserved attributes, got %s %s", info.Mode(), info.ModTime())
+	}
+
+	local := filepath.Join(t.TempDir(), "local")
+	options = TransferOptions{Symlinks: SymlinkFollow}
+	if err = session.Download(context.Background(), remote, local, options); err != nil {
+		t.Fatal(err)
+	}
+
+	assertTree(t, local, map[string]string{
+		"a.txt":          "a",
+		"sub/c.txt":      "c",
+		"sub/deep/d.txt": "d",
+		"link.txt":       "a",
+	})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err = session.Download(ctx, remote, t.TempDir(), options); err == nil {
+		t.Fatal("expected a cancelled transfer to fail")
+	}
+}
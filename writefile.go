@@ -0,0 +1,273 @@
+package sshmgr
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path"
+	"sync/atomic"
+
+	"github.com/pkg/sftp"
+)
+
+// sshFxOpUnsupported is the sftp status code of unsupported operations and extensions
+const sshFxOpUnsupported = 8
+
+// syncCommand flushes a file or directory to stable storage on the remote host,
+// falling back to a full sync for sync implementations not taking arguments.
+// It is only used on servers without the fsync@openssh.com extension
+const syncCommand = `sync -- %s 2>/dev/null || sync`
+
+// fsyncExtension is the sftp extension flushing open handles to stable storage
+const fsyncExtension = "fsync@openssh.com"
+
+// rawSFTPWriteSize is the size of write requests on raw sftp sessions
+const rawSFTPWriteSize = 32 << 10
+
+// errFsyncUnsupported is returned when the server does not advertise fsync@openssh.com
+var errFsyncUnsupported = errors.New("fsync extension unsupported")
+
+// WriteFileOptions configures WriteFile
+type WriteFileOptions struct {
+	// Mode is the file permission bits, defaults to 0644
+	Mode os.FileMode
+
+	// Chown sets the file owner to UID and GID
+	Chown bool
+	UID   int
+	GID   int
+
+	// Sync flushes the file to stable storage before it is renamed into place, and
+	// its directory after. With the fsync@openssh.com extension the file is written
+	// on a dedicated sftp session flushing its write handle. Servers without the
+	// extension must allow running sync commands on the remote host
+	Sync bool
+}
+
+// WriteFile atomically replaces the remote file name with data. Data is written to a
+// temporary file in the same directory which is renamed into place once complete, so
+// readers see either the previous or the new contents, even if the connection drops.
+// The file is renamed with the posix-rename@openssh.com extension when available,
+// otherwise the previous file is moved aside for a plain rename, which is not atomic.
+// The whole write is retried on a dead transport in the resilient client mode
+func (s *SFTPClient) WriteFile(ctx context.Context, name string, data []byte, options WriteFileOptions) (err error) {
+	ctx, span := s.client.tracer.Start(ctx, "sshmgr.sftp.write_file", s.client.attrs...)
+	defer func() { endSpan(span, err) }()
+
+	if options.Mode == 0 {
+		options.Mode = 0644
+	}
+
+	return s.retry(ctx, "sftp.write_file", func(client *sftp.Client) error {
+		return s.writeFile(ctx, client, name, data, options)
+	})
+}
+
+func (s *SFTPClient) writeFile(ctx context.Context, client *sftp.Client, name string, data []byte,
+	options WriteFileOptions) (err error) {
+
+	tmp, err := tempName(name)
+	if err != nil {
+		return err
+	}
+
+	defer func() {
+		if err != nil {
+			if rerr := client.Remove(tmp); rerr != nil && !errors.Is(rerr, os.ErrNotExist) {
+				s.client.log.Warn("failed to remove temporary file", slog.String("path", tmp), slog.Any("error", rerr))
+			}
+		}
+	}()
+
+	m := &meter{ctx: ctx, limits: s.client.mgr.limiters(0)}
+	r := m.reader(bytes.NewReader(data))
+
+	// Synced files are written on a raw sftp session to flush the write handle,
+	// which the sftp client package does not expose. Servers without
+	// fsync@openssh.com are not probed again
+	if options.Sync && atomic.LoadInt32(&s.client.nofsync) == 0 {
+		err = s.client.rawSFTP(ctx, func(conn *rawSFTPConn) (err error) {
+			if !conn.supports(fsyncExtension) {
+				return errFsyncUnsupported
+			}
+			if err = conn.writeFile(tmp, r, options); err != nil {
+				return err
+			}
+			if err = rename(client, tmp, name); err != nil {
+				return err
+			}
+			return conn.fsync(path.Dir(name))
+		})
+
+		if !errors.Is(err, errFsyncUnsupported) {
+			return err
+		}
+		atomic.StoreInt32(&s.client.nofsync, 1)
+		s.client.log.Debug("fsync unsupported, using sync commands")
+	}
+
+	f, err := client.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_EXCL)
+	if err != nil {
+		return err
+	}
+
+	// Attributes are set before writing so the contents are never exposed with wider permissions
+	if err = f.Chmod(options.Mode); err == nil && options.Chown {
+		err = f.Chown(options.UID, options.GID)
+	}
+
+	if err == nil {
+		_, err = io.Copy(f, r)
+	}
+
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return err
+	}
+
+	if options.Sync {
+		if err = s.sync(ctx, tmp); err != nil {
+			return err
+		}
+	}
+
+	if err = rename(client, tmp, name); err != nil {
+		return err
+	}
+
+	if options.Sync {
+		return s.sync(ctx, path.Dir(name))
+	}
+	return nil
+}
+
+// sync flushes the remote file or directory name to stable storage by running syncCommand
+func (s *SFTPClient) sync(ctx context.Context, name string) (err error) {
+	if _, err = s.client.output(ctx, fmt.Sprintf(syncCommand, shellQuote(name))); err != nil {
+		return fmt.Errorf("sync %s: %w", name, err)
+	}
+	return nil
+}
+
+// writeFile creates the file name with the mode and owner of options and writes
+// the contents of r to it, flushing the write handle to stable storage before closing it
+func (c *rawSFTPConn) writeFile(name string, r io.Reader, options WriteFileOptions) (err error) {
+	handle, err := c.open(name, sshFxfWrite|sshFxfCreat|sshFxfExcl)
+	if err != nil {
+		return err
+	}
+
+	// Attributes are set before writing so the contents are never exposed with wider permissions
+	attrs := appendString(nil, handle)
+	if options.Chown {
+		attrs = binary.BigEndian.AppendUint32(attrs, sshFileXferAttrUIDGID|sshFileXferAttrPermissions)
+		attrs = binary.BigEndian.AppendUint32(attrs, uint32(options.UID))
+		attrs = binary.BigEndian.AppendUint32(attrs, uint32(options.GID))
+	} else {
+		attrs = binary.BigEndian.AppendUint32(attrs, sshFileXferAttrPermissions)
+	}
+	attrs = binary.BigEndian.AppendUint32(attrs, uint32(options.Mode.Perm()))
+	err = c.call("fsetstat", name, sshFxpFsetstat, attrs)
+
+	buf := make([]byte, rawSFTPWriteSize)
+	for offset := uint64(0); err == nil; {
+		n, rerr := r.Read(buf)
+		if n > 0 {
+			req := appendString(nil, handle)
+			req = binary.BigEndian.AppendUint64(req, offset)
+			req = appendString(req, string(buf[:n]))
+			err = c.call("write", name, sshFxpWrite, req)
+			offset += uint64(n)
+		}
+
+		if rerr == io.EOF {
+			break
+		}
+		if err == nil {
+			err = rerr
+		}
+	}
+
+	if err == nil {
+		err = c.fsyncHandle(name, handle)
+	}
+
+	if cerr := c.close(name, handle); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// fsync flushes the directory name to stable storage
+// through a handle opened for the fsync@openssh.com request
+func (c *rawSFTPConn) fsync(name string) (err error) {
+	handle, err := c.open(name, sshFxfRead)
+	if err != nil {
+		return err
+	}
+
+	err = c.fsyncHandle(name, handle)
+	if cerr := c.close(name, handle); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// fsyncHandle flushes the open file or directory name to stable storage through its handle
+func (c *rawSFTPConn) fsyncHandle(name, handle string) (err error) {
+	return c.call("fsync", name, sshFxpExtended, appendString(appendString(nil, fsyncExtension), handle))
+}
+
+// rename replaces newname with oldname using posix-rename@openssh.com, or moving
+// newname aside for a plain rename when the extension is not supported
+func rename(client *sftp.Client, oldname, newname string) (err error) {
+	err = client.PosixRename(oldname, newname)
+	var status *sftp.StatusError
+	if !errors.As(err, &status) || status.Code != sshFxOpUnsupported {
+		return err
+	}
+
+	if err = client.Rename(oldname, newname); err == nil {
+		return nil
+	}
+
+	if _, serr := client.Lstat(newname); serr != nil {
+		return err
+	}
+
+	backup, err := tempName(newname)
+	if err != nil {
+		return err
+	}
+
+	if err = client.Rename(newname, backup); err != nil {
+		return err
+	}
+
+	if err = client.Rename(oldname, newname); err != nil {
+		if rerr := client.Rename(backup, newname); rerr != nil {
+			return fmt.Errorf("%w, previous file left at %s: %w", err, backup, rerr)
+		}
+		return err
+	}
+	return client.Remove(backup)
+}
+
+// tempName returns a unique hidden file name in the directory of name
+func tempName(name string) (tmp string, err error) {
+	var suffix [8]byte
+	if _, err = rand.Read(suffix[:]); err != nil {
+		return "", err
+	}
+	dir, base := path.Split(name)
+	return dir + "." + base + ".tmp-" + hex.EncodeToString(suffix[:]), nil
+}
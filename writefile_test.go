@@ -0,0 +1,194 @@
+package sshmgr
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestWriteFile(t *testing.T) {
+	server := newTestServer(t)
+	manager := New(time.Minute, time.Minute)
+	defer manager.Close()
+
+	session, err := manager.SFTPClient(server.clientConfig())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer session.Close()
+
+	dir := t.TempDir()
+	name := filepath.Join(dir, "app.conf")
+	ctx := context.Background()
+
+	if err = session.WriteFile(ctx, name, []byte("old"), WriteFileOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	assertFile(t, name, []byte("old"))
+
+	options := WriteFileOptions{Mode: 0600, Chown: true, UID: os.Getuid(), GID: os.Getgid(), Sync: true}
+	if err = session.WriteFile(ctx, name, []byte("new contents"), options); err != nil {
+		t.Fatal(err)
+	}
+	assertFile(t, name, []byte("new contents"))
+
+	info, err := os.Stat(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Mode().Perm() != 0600 {
+		t.Fatalf("expected mode 0600, got %v", info.Mode().Perm())
+	}
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 {
+		t.Fatalf("expected temporary files to be renamed, found %d entries", len(entries))
+	}
+
+	// The test server does not support fsync@openssh.com, so sync commands are used
+	if atomic.LoadInt32(&session.client.nofsync) != 1 {
+		t.Fatal("expected fsync to be unsupported")
+	}
+
+	if err = session.WriteFile(ctx, filepath.Join(dir, "missing", "app.conf"), nil, options); err == nil {
+		t.Fatal("expected write into a missing directory to fail")
+	}
+	assertFile(t, name, []byte("new contents"))
+}
+
+func TestWriteFileFailure(t *testing.T) {
+	server := newTestServer(t)
+	manager := New(time.Minute, time.Minute, WithRateLimit(64<<10))
+	defer manager.Close()
+
+	session, err := manager.SFTPClient(server.clientConfig())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer session.Close()
+
+	dir := t.TempDir()
+	name := filepath.Join(dir, "app.conf")
+	writeTree(t, dir, map[string]string{"app.conf": "old"})
+
+	// The throttled write is interrupted partway by the deadline
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+
+	data := bytes.Repeat([]byte("x"), 256<<10)
+	if err = session.WriteFile(ctx, name, data, WriteFileOptions{}); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("expected the write to be interrupted, got %v", err)
+	}
+
+	assertFile(t, name, []byte("old"))
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 {
+		t.Fatalf("expected the temporary file to be removed, found %d entries", len(entries))
+	}
+}
+
+func TestFsync(t *testing.T) {
+	cc, sc := net.Pipe()
+	defer cc.Close()
+	defer sc.Close()
+
+	var ops []string
+	var written []byte
+	go func() {
+		server := &rawSFTPConn{r: sc, w: sc}
+		if _, _, err := server.recv(); err != nil {
+			return
+		}
+
+		version := binary.BigEndian.AppendUint32(nil, 3)
+		version = appendString(appendString(version, fsyncExtension), "1")
+		server.send(sshFxpVersion, version)
+
+		for {
+			typ, req, err := server.recv()
+			if err != nil {
+				return
+			}
+
+			reply := append([]byte{}, req[:4]...)
+			switch typ {
+			case sshFxpOpen:
+				name, rest, _ := parseString(req[4:])
+				if name == "missing" {
+					reply = binary.BigEndian.AppendUint32(reply, sshFxNoSuchFile)
+					server.send(sshFxpStatus, appendString(appendString(reply, "no such file"), ""))
+					continue
+				}
+				ops = append(ops, fmt.Sprintf("open %s %#x", name, binary.BigEndian.Uint32(rest)))
+				server.send(sshFxpHandle, appendString(reply, "h:"+name))
+				continue
+			case sshFxpFsetstat:
+				handle, rest, _ := parseString(req[4:])
+				ops = append(ops, fmt.Sprintf("fsetstat %s %#x %o", handle, binary.BigEndian.Uint32(rest),
+					binary.BigEndian.Uint32(rest[len(rest)-4:])))
+			case sshFxpWrite:
+				handle, rest, _ := parseString(req[4:])
+				data, _, _ := parseString(rest[8:])
+				if binary.BigEndian.Uint64(rest) != uint64(len(written)) {
+					return
+				}
+				written = append(written, data...)
+				ops = append(ops, "write "+handle)
+			case sshFxpExtended:
+				name, rest, _ := parseString(req[4:])
+				handle, _, _ := parseString(rest)
+				ops = append(ops, name+" "+handle)
+			case sshFxpClose:
+				handle, _, _ := parseString(req[4:])
+				ops = append(ops, "close "+handle)
+			}
+			reply = binary.BigEndian.AppendUint32(reply, sshFxOk)
+			server.send(sshFxpStatus, appendString(appendString(reply, ""), ""))
+		}
+	}()
+
+	conn := &rawSFTPConn{r: cc, w: cc}
+	if err := conn.init(); err != nil {
+		t.Fatal(err)
+	}
+	if !conn.supports(fsyncExtension) {
+		t.Fatal("expected fsync to be supported")
+	}
+
+	data := bytes.Repeat([]byte("x"), rawSFTPWriteSize+1)
+	if err := conn.writeFile("tmp", bytes.NewReader(data), WriteFileOptions{Mode: 0600}); err != nil {
+		t.Fatal(err)
+	}
+	if err := conn.fsync("dir"); err != nil {
+		t.Fatal(err)
+	}
+	if err := conn.fsync("missing"); !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("expected a missing file error, got %v", err)
+	}
+
+	// The write handle is flushed before it is closed
+	expected := []string{"open tmp 0x2a", "fsetstat h:tmp 0x4 600", "write h:tmp", "write h:tmp",
+		"fsync@openssh.com h:tmp", "close h:tmp", "open dir 0x1", "fsync@openssh.com h:dir", "close h:dir"}
+	if !reflect.DeepEqual(ops, expected) {
+		t.Fatalf("expected %v, got %v", expected, ops)
+	}
+	if !bytes.Equal(written, data) {
+		t.Fatalf("expected %d written bytes, got %d", len(data), len(written))
+	}
+}